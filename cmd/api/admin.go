@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// runRecomputeRatings implements the "recompute-ratings" command, which
+// backfills average_rating and review_count from the reviews table.
+func runRecomputeRatings(db *sql.DB, logger *slog.Logger, timeouts data.QueryTimeouts) error {
+	products := data.ProductModel{DB: db, Timeouts: timeouts}
+	updated, err := products.RecomputeRatings(context.Background())
+	if err != nil {
+		return err
+	}
+	logger.Info("product ratings recomputed", "products_updated", updated)
+	return nil
+}
+
+// runReindexSearch implements the "reindex-search" command, which rebuilds
+// the product search vectors after -search-language has changed.
+func runReindexSearch(db *sql.DB, logger *slog.Logger, language string, timeouts data.QueryTimeouts) error {
+	products := data.ProductModel{DB: db, SearchLanguage: language, Timeouts: timeouts}
+	updated, err := products.Reindex(context.Background())
+	if err != nil {
+		return err
+	}
+	logger.Info("product search reindexed", "language", language, "products_updated", updated)
+	return nil
+}
+
+// runPurge implements the "purge" command, which permanently removes the
+// products and reviews that have been in the trash for longer than
+// retention.
+func runPurge(db *sql.DB, logger *slog.Logger, retention time.Duration, timeouts data.QueryTimeouts) error {
+	if retention <= 0 {
+		return errors.New("-trash-retention must be positive")
+	}
+
+	// Products first, taking the reviews deleted with them along
+	ctx := commandContext("purge")
+	products, err := data.ProductModel{DB: db, Timeouts: timeouts}.Purge(ctx, retention)
+	if err != nil {
+		return err
+	}
+	reviews, err := data.ReviewModel{DB: db, Timeouts: timeouts}.Purge(ctx, retention)
+	if err != nil {
+		return err
+	}
+	logger.Info("trash purged", "retention", retention, "products_removed", products, "reviews_removed", reviews,
+		"request_id", data.ActorFromContext(ctx).RequestID)
+	return nil
+}
+
+// commandContext returns the context of a run of an admin command, whose
+// changes are made by the system rather than by a user. Its actor has no
+// user or client, and a request ID naming the command and the time it ran,
+// so that the audit events of one run can be found together.
+func commandContext(command string) context.Context {
+	requestID := fmt.Sprintf("system:%s:%s", command, time.Now().UTC().Format("20060102T150405Z"))
+	return data.ContextWithActor(context.Background(), data.Actor{RequestID: requestID})
+}
+
+// runGrantPermissions implements the "grant-permissions EMAIL CODE..."
+// command, used by staff to hand out permissions such as products:write.
+func runGrantPermissions(db *sql.DB, logger *slog.Logger, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: grant-permissions EMAIL CODE...")
+	}
+	email, codes := args[0], args[1:]
+	for _, code := range codes {
+		if !slices.Contains(data.PermissionCodes, code) {
+			return fmt.Errorf("unknown permission %q (expected one of %v)", code, data.PermissionCodes)
+		}
+	}
+
+	user, err := data.UserModel{DB: db}.GetByEmail(context.Background(), email)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return fmt.Errorf("no user with email %q", email)
+		}
+		return err
+	}
+
+	err = data.PermissionModel{DB: db}.AddForUser(context.Background(), user.ID, codes...)
+	if err != nil {
+		return err
+	}
+	logger.Info("permissions granted", "user_id", user.ID, "permissions", codes)
+	return nil
+}
+
+// seedAdmin creates an activated user holding every permission from an
+// "email:password" pair. It exists so that the in-memory store, which has no
+// psql or grant-permissions access, can be used for write requests locally.
+func (a *applicationDependencies) seedAdmin(credentials string) error {
+	email, plaintext, ok := strings.Cut(credentials, ":")
+	if !ok {
+		return errors.New("-memory-admin must be in the form email:password")
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, plaintext)
+	if !v.IsEmpty() {
+		return fmt.Errorf("invalid -memory-admin: %v", v.Errors)
+	}
+
+	user := &data.User{Name: "admin", Email: email, Activated: true}
+	err := user.Password.Set(plaintext)
+	if err != nil {
+		return err
+	}
+	data.ValidateUser(v, user)
+	if !v.IsEmpty() {
+		return fmt.Errorf("invalid -memory-admin: %v", v.Errors)
+	}
+
+	err = a.models.Users.Insert(context.Background(), user)
+	if err != nil {
+		return err
+	}
+	err = a.models.Permissions.AddForUser(context.Background(), user.ID, data.PermissionCodes...)
+	if err != nil {
+		return err
+	}
+	a.logger.Info("seeded in-memory admin user", "email", email)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// auditExportTimeout bounds an NDJSON export of the audit log, which can
+// outlast the server's write timeout.
+const auditExportTimeout = 5 * time.Minute
+
+// Handler to list the audit log, the latest events first, or to export it
+// as NDJSON (one event per line, oldest first) with format=ndjson
+func (a *applicationDependencies) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse query parameters for filtering
+	var filter data.AuditFilter
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	filter.ActorID = int64(a.getSingleIntegerParameter(queryParameters, "actor_id", 0, v))
+	filter.Resource = a.getSingleQueryParameter(queryParameters, "resource", "")
+	filter.ResourceID = int64(a.getSingleIntegerParameter(queryParameters, "resource_id", 0, v))
+	filter.Action = a.getSingleQueryParameter(queryParameters, "action", "")
+	filter.RequestID = a.getSingleQueryParameter(queryParameters, "request_id", "")
+	filter.CreatedAfter = a.getSingleTimeParameter(queryParameters, "created_after", v)
+	filter.CreatedBefore = a.getSingleTimeParameter(queryParameters, "created_before", v)
+	data.ValidateAuditFilter(v, filter)
+
+	format := a.getSingleQueryParameter(queryParameters, "format", "json")
+	v.Check(validator.PermittedValue(format, "json", "ndjson"), "format", "must be json or ndjson")
+	if format == "ndjson" {
+		if !v.IsEmpty() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		a.exportAuditEvents(w, r, filter)
+		return
+	}
+
+	// Parse query parameters for pagination and sorting
+	var filters data.Filters
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 20, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "-id")
+	filters.SortSafeList = data.AuditSortSafeList
+	filters.Cursor = a.getCursorParameter(queryParameters, v)
+	filters.Count = a.getCountParameter(queryParameters, filters.Cursor)
+
+	// Validate filters and handle errors if necessary
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := a.models.Audit.GetAll(r.Context(), filter, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	metadata.EncodeCursors(a.cursors)
+
+	// Respond with the events and pagination metadata in JSON format
+	data := envelope{"events": events, "@metadata": metadata}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// exportAuditEvents streams the events that pass the filter as NDJSON. Once
+// the first event is sent an error can no longer be reported in the
+// response, so the connection is aborted instead, leaving the client with
+// an incomplete response rather than a seemingly complete export.
+func (a *applicationDependencies) exportAuditEvents(w http.ResponseWriter, r *http.Request, filter data.AuditFilter) {
+	ctx, cancel := context.WithTimeout(r.Context(), auditExportTimeout)
+	defer cancel()
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(auditExportTimeout))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+
+	encoder := json.NewEncoder(w)
+	err = a.models.Audit.Export(ctx, filter, func(event *data.AuditEvent) error {
+		if !started {
+			start()
+		}
+		return encoder.Encode(event)
+	})
+	switch {
+	case err != nil && !started:
+		a.serverErrorResponse(w, r, err)
+	case err != nil:
+		a.logError(r, err)
+		panic(http.ErrAbortHandler)
+	case !started:
+		start()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+)
+
+// productETag returns the strong entity tag of a single product. It follows
+// the version, which If-Match writes are checked against, so reviews, which
+// refresh the rating without changing the version, leave it as it is; they
+// move Last-Modified instead.
+func productETag(product *data.Product) string {
+	return fmt.Sprintf(`"product-%d-v%d"`, product.ID, product.Version)
+}
+
+// reviewETag returns the strong entity tag of a single review.
+func reviewETag(review *data.Review) string {
+	return fmt.Sprintf(`"review-%d-v%d"`, review.ID, review.Version)
+}
+
+// productsETag returns a weak entity tag for a page of products. It changes
+// whenever a product on the page is added, removed, updated or re-rated, or
+// the pagination metadata or the facet counts (nil when not requested)
+// change.
+func productsETag(products []*data.Product, metadata data.Metadata, facets data.Facets) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "products|%+v", metadata)
+	if facets != nil {
+		// JSON has the facets sorted by name and the bounds dereferenced
+		counts, _ := json.Marshal(facets)
+		fmt.Fprintf(h, "|%s", counts)
+	}
+	for _, product := range products {
+		fmt.Fprintf(h, "|%d:%d:%d:%g", product.ID, product.Version, product.ReviewCount, product.AverageRating)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// reviewsETag returns a weak entity tag for a page of reviews.
+func reviewsETag(reviews []*data.Review, metadata data.Metadata) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "reviews|%+v", metadata)
+	for _, review := range reviews {
+		fmt.Fprintf(h, "|%d:%d", review.ID, review.Version)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// shapedValidatorHeaders builds the validator headers of a representation
+// trimmed by fields or extended by include. The same product versions give
+// different bodies depending on the shape and on the embedded reviews, so
+// the entity tag is a weak one computed from the encoded representation.
+// Embedded reviews can change without the product, so Last-Modified is
+// only sent when nothing is included.
+func shapedValidatorHeaders(representation any, shape productShape, lastModified time.Time) (http.Header, error) {
+	encoded, err := json.Marshal(representation)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(encoded)
+	if len(shape.include) > 0 {
+		lastModified = time.Time{}
+	}
+	return validatorHeaders(`W/"`+hex.EncodeToString(sum[:16])+`"`, lastModified), nil
+}
+
+// validatorHeaders builds the ETag and (when known) Last-Modified headers for
+// a response.
+func validatorHeaders(etag string, lastModified time.Time) http.Header {
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	if !lastModified.IsZero() {
+		headers.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	return headers
+}
+
+// notModified reports whether a GET can be answered with 304 Not Modified,
+// and if so writes that response. If-None-Match takes precedence over
+// If-Modified-Since, as required by RFC 9110.
+func (a *applicationDependencies) notModified(w http.ResponseWriter, r *http.Request, headers http.Header) bool {
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		match = etagListMatches(inm, headers.Get("ETag"), true)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && headers.Get("Last-Modified") != "" {
+		since, err := http.ParseTime(ims)
+		lastModified, lerr := http.ParseTime(headers.Get("Last-Modified"))
+		match = err == nil && lerr == nil && !lastModified.After(since)
+	}
+	if !match {
+		return false
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// preconditionsMet evaluates If-Match and If-Unmodified-Since for a write to
+// an existing resource. For compatibility with clients that send the bare
+// version number, If-Match also accepts a quoted version such as "3".
+func preconditionsMet(r *http.Request, etag string, version int32, lastModified time.Time) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		return etagListMatches(im, etag, false) ||
+			etagListMatches(im, fmt.Sprintf(`"%d"`, version), false)
+	}
+	if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ius)
+		if err == nil && lastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	return true
+}
+
+// etagListMatches reports whether etag appears in the comma-separated header
+// value, or the value is "*". Weak comparison ignores the W/ prefix on both
+// sides; strong comparison never matches a weak tag.
+func etagListMatches(headerValue, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(headerValue, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(candidate, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/martinezmoises/Test1/internal/data"
+)
+
+type contextKey string
+
+const userContextKey = contextKey("user")
+
+// contextSetUser returns a copy of the request carrying the given user,
+// who is also the actor the models record changes against.
+func (a *applicationDependencies) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	actor := data.ActorFromContext(ctx)
+	actor.UserID = user.ID
+	ctx = data.ContextWithActor(ctx, actor)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the user stored by the authenticate middleware. It
+// panics if called on a request that did not pass through authenticate.
+func (a *applicationDependencies) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+	return user
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/martinezmoises/Test1/internal/data"
 )
 
 func (a *applicationDependencies) logError(r *http.Request, err error) {
 
 	method := r.Method
 	uri := r.URL.RequestURI()
-	a.logger.Error(err.Error(), "method", method, "uri", uri)
+	a.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", data.ActorFromContext(r.Context()).RequestID)
 }
 
 func (a *applicationDependencies) errorResponseJSON(w http.ResponseWriter, r *http.Request, status int, message any) {
@@ -24,12 +28,41 @@ func (a *applicationDependencies) errorResponseJSON(w http.ResponseWriter, r *ht
 }
 
 func (a *applicationDependencies) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// Requests abandoned by their client or cut short by a deadline are not server faults
+	switch {
+	case r.Context().Err() != nil:
+		a.requestCanceledResponse(w, r, err)
+		return
+	case data.IsTimeout(err):
+		a.timeoutResponse(w, r, err)
+		return
+	}
 
 	a.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	a.errorResponseJSON(w, r, http.StatusInternalServerError, message)
 }
 
+// requestCanceledResponse handles a request whose context was cancelled: the
+// client went away, in which case nothing is sent, or the server is shutting
+// down (503 - Service Unavailable)
+func (a *applicationDependencies) requestCanceledResponse(w http.ResponseWriter, r *http.Request, err error) {
+	cause := context.Cause(r.Context())
+	a.logger.Warn("request canceled", "method", r.Method, "uri", r.URL.RequestURI(), "cause", cause.Error(), "error", err.Error())
+	if errors.Is(cause, errShuttingDown) {
+		w.Header().Set("Connection", "close")
+		message := "the server is shutting down, please retry"
+		a.errorResponseJSON(w, r, http.StatusServiceUnavailable, message)
+	}
+}
+
+// send an error response if a database operation ran past its deadline (503 - Service Unavailable)
+func (a *applicationDependencies) timeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	a.logger.Warn("request timed out", "method", r.Method, "uri", r.URL.RequestURI(), "error", err.Error())
+	message := "the server took too long to process your request, please retry"
+	a.errorResponseJSON(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (a *applicationDependencies) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 
 	message := "the requested resource could not be found"
@@ -53,6 +86,82 @@ func (a *applicationDependencies) failedValidationResponse(w http.ResponseWriter
 	a.errorResponseJSON(w, r, http.StatusUnprocessableEntity, errors)
 }
 
+// send an error response if the record changed since the client read it (409 - Conflict)
+func (a *applicationDependencies) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// send an error response if an If-Match or If-Unmodified-Since precondition fails (412 - Precondition Failed)
+func (a *applicationDependencies) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since the supplied precondition was computed"
+	a.errorResponseJSON(w, r, http.StatusPreconditionFailed, message)
+}
+
+// send an error response if the email address or password is wrong (401 - Unauthorized)
+func (a *applicationDependencies) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	a.errorResponseJSON(w, r, http.StatusUnauthorized, message)
+}
+
+// send an error response if the bearer token is malformed, unknown or expired (401 - Unauthorized)
+func (a *applicationDependencies) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	message := "invalid or missing authentication token"
+	a.errorResponseJSON(w, r, http.StatusUnauthorized, message)
+}
+
+// send an error response if an anonymous user calls a protected endpoint (401 - Unauthorized)
+func (a *applicationDependencies) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	message := "you must be authenticated to access this resource"
+	a.errorResponseJSON(w, r, http.StatusUnauthorized, message)
+}
+
+// send an error response if the user has not activated their account (403 - Forbidden)
+func (a *applicationDependencies) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+// send an error response if the user lacks the permission for an action (403 - Forbidden)
+func (a *applicationDependencies) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	a.errorResponseJSON(w, r, http.StatusForbidden, message)
+}
+
+// send an error response if a PATCH body is not in a supported media type (415 - Unsupported Media Type)
+func (a *applicationDependencies) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Patch", mediaTypeJSON+", "+mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+	message := fmt.Sprintf("the Content-Type must be one of %s, %s or %s", mediaTypeJSON, mediaTypeMergePatch, mediaTypeJSONPatch)
+	a.errorResponseJSON(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// send an error response if a JSON Patch test operation does not hold (409 - Conflict)
+func (a *applicationDependencies) patchTestFailedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	message := fmt.Sprintf("the patch was not applied: %v", err)
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// send an error response if an Idempotency-Key is reused for a different request (422 - Unprocessable Entity)
+func (a *applicationDependencies) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key has already been used for a different request"
+	a.errorResponseJSON(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// send an error response if the request with the same Idempotency-Key is still being processed (409 - Conflict)
+func (a *applicationDependencies) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "a request with the same Idempotency-Key is still being processed, please retry later"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// send an error response if the request with the same Idempotency-Key succeeded but its response was not stored (409 - Conflict)
+func (a *applicationDependencies) idempotentResponseLostResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with the same Idempotency-Key succeeded but its response could not be stored, please check its outcome instead of retrying"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
 // send an error response if rate limit exceeded (429 - Too Many Requests)
 func (a *applicationDependencies)rateLimitExceededResponse(w http.ResponseWriter,r *http.Request)  {
 
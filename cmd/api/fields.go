@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"slices"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// productShape is how product representations are trimmed and extended by
+// the fields, include and reviews_limit query parameters.
+type productShape struct {
+	fields       []string // JSON fields to keep, every field when empty
+	include      []string // related resources to embed
+	reviewsLimit int      // reviews embedded per product
+}
+
+// readProductShape reads and validates the parameters of a productShape.
+func (a *applicationDependencies) readProductShape(queryParameters url.Values, v *validator.Validator) productShape {
+	shape := productShape{
+		fields:       a.getCommaSeparatedParameter(queryParameters, "fields"),
+		include:      a.getCommaSeparatedParameter(queryParameters, "include"),
+		reviewsLimit: a.getSingleIntegerParameter(queryParameters, "reviews_limit", 3, v),
+	}
+	data.ValidateProductShape(v, shape.fields, shape.include, shape.reviewsLimit)
+	return shape
+}
+
+// isZero reports whether the shape leaves representations untouched.
+func (s productShape) isZero() bool {
+	return len(s.fields) == 0 && len(s.include) == 0
+}
+
+// shapeProducts returns the representations of products as JSON objects
+// holding only the selected fields, with the included resources embedded.
+// Reviews are read for every product at once.
+func (a *applicationDependencies) shapeProducts(ctx context.Context, products []*data.Product, shape productShape) ([]map[string]json.RawMessage, error) {
+	var reviews map[int64][]*data.Review
+	if slices.Contains(shape.include, "reviews") {
+		ids := make([]int64, len(products))
+		for i, product := range products {
+			ids[i] = product.ID
+		}
+		var err error
+		reviews, err = a.models.Reviews.GetTopForProducts(ctx, ids, shape.reviewsLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shaped := make([]map[string]json.RawMessage, len(products))
+	for i, product := range products {
+		encoded, err := json.Marshal(product)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		err = json.Unmarshal(encoded, &all)
+		if err != nil {
+			return nil, err
+		}
+
+		shaped[i] = all
+		if len(shape.fields) > 0 {
+			shaped[i] = make(map[string]json.RawMessage, len(shape.fields)+1)
+			for _, field := range shape.fields {
+				if value, ok := all[field]; ok {
+					shaped[i][field] = value
+				}
+			}
+		}
+
+		if reviews != nil {
+			productReviews := reviews[product.ID]
+			if productReviews == nil {
+				productReviews = []*data.Review{}
+			}
+			shaped[i]["reviews"], err = json.Marshal(productReviews)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return shaped, nil
+}
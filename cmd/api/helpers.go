@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/martinezmoises/Test1/internal/data"
 	"github.com/martinezmoises/Test1/internal/validator"
 
 	"github.com/julienschmidt/httprouter"
@@ -103,6 +106,55 @@ func (a *applicationDependencies) readIDParam(r *http.Request) (int64, error) {
 
 }
 
+func (a *applicationDependencies) readReviewIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("review_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid review_id parameter")
+	}
+
+	return id, nil
+}
+
+func (a *applicationDependencies) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+
+	return int32(version), nil
+}
+
+// staticParam returns a handler that serves requests whose URL parameter
+// name equals value with static, and the others with next. It stands in for
+// a static route that would conflict with a parameter in httprouter.
+func (a *applicationDependencies) staticParam(name, value string, static, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName(name) == value {
+			static(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readExpectedVersion returns the version the client expects the resource to
+// be at, taken from the X-Expected-Version header. ok is false when the
+// header is absent. If-Match is handled separately by preconditionsMet.
+func (a *applicationDependencies) readExpectedVersion(r *http.Request) (version int32, ok bool, err error) {
+	value := r.Header.Get("X-Expected-Version")
+	if value == "" {
+		return 0, false, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || parsed < 1 {
+		return 0, false, errors.New("the X-Expected-Version header must contain a positive version number")
+	}
+	return int32(parsed), true, nil
+}
+
 func (a *applicationDependencies) getSingleQueryParameter(
 	queryParameters url.Values,
 	key string,
@@ -135,3 +187,123 @@ func (a *applicationDependencies) getSingleIntegerParameter(
 
 	return intValue
 }
+
+// getCommaSeparatedParameter splits a parameter such as ?category=a,b,c into
+// its values, or returns nil when it is absent.
+func (a *applicationDependencies) getCommaSeparatedParameter(
+	queryParameters url.Values,
+	key string) []string {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return nil
+	}
+	values := strings.Split(result, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+func (a *applicationDependencies) getSingleFloatParameter(
+	queryParameters url.Values,
+	key string,
+	defaultValue float64,
+	v *validator.Validator) float64 {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(result, 64)
+	if err != nil || math.IsNaN(floatValue) || math.IsInf(floatValue, 0) {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+
+	return floatValue
+}
+
+// getSingleTimeParameter accepts an RFC 3339 timestamp or a date
+// (2006-01-02, meaning midnight UTC). It returns the zero time when the
+// parameter is absent.
+func (a *applicationDependencies) getSingleTimeParameter(
+	queryParameters url.Values,
+	key string,
+	v *validator.Validator) time.Time {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, result)
+		if err == nil {
+			return t
+		}
+	}
+	v.AddError(key, "must be a date (2006-01-02) or an RFC 3339 timestamp")
+	return time.Time{}
+}
+
+// getSingleBoolParameter returns nil when the parameter is absent.
+func (a *applicationDependencies) getSingleBoolParameter(
+	queryParameters url.Values,
+	key string,
+	v *validator.Validator) *bool {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return nil
+	}
+	boolValue, err := strconv.ParseBool(result)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+
+	return &boolValue
+}
+
+// getCursorParameter decodes the cursor query parameter, returning the zero
+// cursor (page mode) when it is absent. A cursor replaces page, so the two
+// cannot be combined.
+func (a *applicationDependencies) getCursorParameter(queryParameters url.Values, v *validator.Validator) data.Cursor {
+	token := queryParameters.Get("cursor")
+	if token == "" {
+		return data.Cursor{}
+	}
+	if queryParameters.Has("page") {
+		v.AddError("cursor", "cannot be combined with page")
+		return data.Cursor{}
+	}
+
+	cursor, err := a.cursors.Decode(token)
+	if err != nil {
+		v.AddError("cursor", "must be a cursor returned by a previous request")
+		return data.Cursor{}
+	}
+	return cursor
+}
+
+// getCountParameter reads the count query parameter. Page-based listings
+// are counted exactly by default and cursor-based ones are not counted.
+func (a *applicationDependencies) getCountParameter(queryParameters url.Values, cursor data.Cursor) string {
+	defaultValue := data.CountExact
+	if !cursor.IsZero() {
+		defaultValue = data.CountNone
+	}
+	return a.getSingleQueryParameter(queryParameters, "count", defaultValue)
+}
+
+// background runs fn in a goroutine that is tracked by a.wg, so that
+// graceful shutdown waits for it, and whose panics are logged rather than
+// crashing the server.
+func (a *applicationDependencies) background(fn func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				a.logger.Error(fmt.Sprintf("%v", err))
+			}
+		}()
+		fn()
+	}()
+}
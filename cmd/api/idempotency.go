@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// maxIdempotentBodyBytes bounds the body read to fingerprint a request.
+// Handlers apply their own, smaller limits afterwards.
+const maxIdempotentBodyBytes = 1 << 20
+
+// idempotent makes a POST handler safe to retry. The first response to a
+// request carrying an Idempotency-Key header is stored against the key and
+// a fingerprint of the body, and retries get it back with an
+// Idempotent-Replayed header. Reusing a key for a different body is
+// rejected with 422, and retrying while the first request is still being
+// processed, or after it succeeded without its response being stored, with
+// 409. Requests without the header are passed through.
+func (a *applicationDependencies) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyValue := r.Header.Get("Idempotency-Key")
+		if keyValue == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		data.ValidateIdempotencyKey(v, keyValue)
+		if !v.IsEmpty() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		if err != nil {
+			a.badRequestResponse(w, r, fmt.Errorf("the body could not be read: %w", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.Sum256(body)
+		key := data.IdempotencyKey{UserID: a.contextGetUser(r).ID, Key: keyValue}
+		request := data.IdempotentRequest{Endpoint: r.Method + " " + r.URL.Path, Fingerprint: fingerprint[:]}
+
+		claim, stored, err := a.idempotencyModel.Begin(r.Context(), key, request, a.config.idempotencyTTL)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				a.idempotencyKeyMismatchResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyKeyInUse):
+				a.idempotencyKeyInUseResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyResponseLost):
+				a.idempotentResponseLostResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if stored != nil {
+			for name, values := range stored.Headers {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// Give the key up unless the handler succeeded, so that requests
+		// that failed on our side, or panicked, can be retried. The key is
+		// settled even if the client has gone away in the meantime.
+		ctx := context.WithoutCancel(r.Context())
+		stopRenewing := a.renewIdempotencyLease(ctx, r, claim)
+		release := true
+		defer func() {
+			stopRenewing()
+			if release {
+				err := a.idempotencyModel.Release(ctx, claim)
+				if err != nil {
+					a.logError(r, err)
+				}
+			}
+		}()
+
+		// The response is held back until it is stored, so that a failure
+		// to store it can still be answered with an error
+		recorder := newResponseRecorder(w)
+		next.ServeHTTP(recorder, r)
+		stopRenewing()
+
+		if recorder.status == 0 || recorder.status >= 500 {
+			recorder.flush()
+			return
+		}
+		// Once the handler succeeded its effects are done, so the key is
+		// never given up
+		if recorder.status < 300 {
+			release = false
+		}
+
+		// Only the headers set by the handler belong to the response; the
+		// others, such as RateLimit-*, describe this particular request
+		headers := make(http.Header)
+		for name, values := range recorder.header {
+			if !slices.Equal(w.Header()[name], values) {
+				headers[name] = values
+			}
+		}
+		err = a.idempotencyModel.Complete(ctx, claim, &data.IdempotentResponse{Status: recorder.status, Headers: headers, Body: recorder.body.Bytes()})
+		switch {
+		case errors.Is(err, data.ErrIdempotencyClaimLost):
+			// A retry took the key over after the lease ran out; the
+			// response still answers this request
+			a.logError(r, err)
+		case err != nil:
+			// Mark the key as succeeded instead, so that retries are
+			// refused rather than run again
+			if recorder.status < 300 {
+				err := a.idempotencyModel.Succeed(ctx, claim)
+				if err != nil {
+					a.logError(r, err)
+				}
+			}
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		release = false
+		recorder.flush()
+	}
+}
+
+// renewIdempotencyLease renews the lease of claim until the returned
+// function is called, so that a retry cannot take the key over from a
+// request that is slow rather than lost.
+func (a *applicationDependencies) renewIdempotencyLease(ctx context.Context, r *http.Request, claim *data.IdempotencyClaim) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(data.IdempotencyLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := a.idempotencyModel.Renew(ctx, claim)
+				if err != nil {
+					a.logError(r, err)
+					if errors.Is(err, data.ErrIdempotencyClaimLost) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return sync.OnceFunc(func() {
+		close(done)
+		<-stopped
+	})
+}
+
+// responseRecorder holds a response back, keeping its headers, status and
+// body until flush writes them out.
+type responseRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, header: w.Header().Clone()}
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.body.Write(b)
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// flush writes the held back response.
+func (rr *responseRecorder) flush() {
+	if rr.status == 0 {
+		return
+	}
+	for name, values := range rr.header {
+		rr.ResponseWriter.Header()[name] = values
+	}
+	rr.ResponseWriter.WriteHeader(rr.status)
+	rr.ResponseWriter.Write(rr.body.Bytes())
+}
+
+// cleanupIdempotencyKeys deletes expired idempotency keys every interval
+// until done is closed.
+func (a *applicationDependencies) cleanupIdempotencyKeys(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			deleted, err := a.idempotencyModel.DeleteExpired(context.Background())
+			if err != nil {
+				a.logger.Error(err.Error())
+				continue
+			}
+			if deleted > 0 {
+				a.logger.Info("expired idempotency keys deleted", "keys", deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+)
+
+// failingCompleteStore is an IdempotencyStore that cannot store responses.
+type failingCompleteStore struct {
+	data.IdempotencyStore
+}
+
+func (s failingCompleteStore) Complete(ctx context.Context, claim *data.IdempotencyClaim, response *data.IdempotentResponse) error {
+	return errors.New("store unavailable")
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name        string
+		store       func(store *data.MemoryStore) data.IdempotencyStore
+		status      int
+		wantFirst   int
+		wantRetry   int
+		wantReplay  bool
+		wantHandled int
+	}{
+		{
+			name:        "stored response is replayed",
+			store:       func(store *data.MemoryStore) data.IdempotencyStore { return data.MemoryIdempotencyModel{Store: store} },
+			status:      http.StatusCreated,
+			wantFirst:   http.StatusCreated,
+			wantRetry:   http.StatusCreated,
+			wantReplay:  true,
+			wantHandled: 1,
+		},
+		{
+			name:        "server errors release the key",
+			store:       func(store *data.MemoryStore) data.IdempotencyStore { return data.MemoryIdempotencyModel{Store: store} },
+			status:      http.StatusInternalServerError,
+			wantFirst:   http.StatusInternalServerError,
+			wantRetry:   http.StatusInternalServerError,
+			wantHandled: 2,
+		},
+		{
+			name: "success that cannot be stored is not run again",
+			store: func(store *data.MemoryStore) data.IdempotencyStore {
+				return failingCompleteStore{data.MemoryIdempotencyModel{Store: store}}
+			},
+			status:      http.StatusCreated,
+			wantFirst:   http.StatusInternalServerError,
+			wantRetry:   http.StatusConflict,
+			wantHandled: 1,
+		},
+		{
+			name: "client error that cannot be stored releases the key",
+			store: func(store *data.MemoryStore) data.IdempotencyStore {
+				return failingCompleteStore{data.MemoryIdempotencyModel{Store: store}}
+			},
+			status:      http.StatusUnprocessableEntity,
+			wantFirst:   http.StatusInternalServerError,
+			wantRetry:   http.StatusInternalServerError,
+			wantHandled: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &applicationDependencies{
+				logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+				idempotencyModel: tt.store(data.NewMemoryStore()),
+			}
+			a.config.idempotencyTTL = time.Hour
+
+			handled := 0
+			handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+				handled++
+				w.Header().Set("Location", "/v1/products/1")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"id":1}`))
+			})
+
+			send := func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(`{"name":"A"}`))
+				r.Header.Set("Idempotency-Key", "key-1")
+				r = a.contextSetUser(r, &data.User{ID: 1})
+				w := httptest.NewRecorder()
+				handler(w, r)
+				return w
+			}
+
+			first := send()
+			if first.Code != tt.wantFirst {
+				t.Fatalf("first response status = %d, want %d", first.Code, tt.wantFirst)
+			}
+			if first.Code != tt.status && first.Header().Get("Location") != "" {
+				t.Errorf("error response carries the handler's Location header")
+			}
+
+			retry := send()
+			if retry.Code != tt.wantRetry {
+				t.Fatalf("retry status = %d, want %d", retry.Code, tt.wantRetry)
+			}
+			if replayed := retry.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplay {
+				t.Errorf("retry replayed = %t, want %t", replayed, tt.wantReplay)
+			}
+			if tt.wantReplay && retry.Body.String() != first.Body.String() {
+				t.Errorf("replayed body = %q, want %q", retry.Body, first.Body)
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("handler ran %d times, want %d", handled, tt.wantHandled)
+			}
+		})
+	}
+}
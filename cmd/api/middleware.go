@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
-	"golang.org/x/time/rate"
-	"sync"  
-	"time"
-	"net"
+	"regexp"
+	"strings"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
 )
 
 func (a *applicationDependencies) recoverPanic(next http.Handler) http.Handler {
@@ -15,6 +19,11 @@ func (a *applicationDependencies) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			// recover() checks for panics
 			err := recover()
+			// Handlers abort their connection on purpose with
+			// http.ErrAbortHandler, which the server handles
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
 			if err != nil {
 				w.Header().Set("Connection", "close")
 				a.serverErrorResponse(w, r, fmt.Errorf("%s", err))
@@ -24,63 +33,148 @@ func (a *applicationDependencies) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (a *applicationDependencies)rateLimit(next http.Handler) http.Handler {
-	// Define a rate limiter struct
-		type client struct {
-			limiter *rate.Limiter
-			lastSeen  time.Time   // remove map entries that are stale
-	}
-	var mu sync.Mutex           // use to synchronize the map
-	var clients = make(map[string]*client)    // the actual map 
-	// A goroutine to remove stale entries from the map
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mu.Lock()         // begin cleanup
-			// delete any entry not seen in three minutes
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3 * time.Minute {
-					delete(clients, ip)
-				}
-			}
-		  mu.Unlock()    // finish clean up
-		  }
-   }()
-   
-   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	// get the IP address
-	if a.config.limiter.enabled {
-
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// requestIDRX matches the request IDs accepted from trusted proxies.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,200}$`)
+
+// identifyRequest gives the request an ID, which is the X-Request-Id header
+// of a trusted proxy or a random one, and returns it in the X-Request-Id
+// response header. The ID and the client's address are stored on the
+// request context as the data.Actor that authenticate completes with the
+// user.
+func (a *applicationDependencies) identifyRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := clientIP(r, a.config.limiter.trustedProxies)
 		if err != nil {
 			a.serverErrorResponse(w, r, err)
 			return
 		}
-   
-		mu.Lock()  // exclusive access to the map
-	
-		// check if ip address already in map, if not add it
-		_, found := clients[ip]
-	   if !found {
-		   clients[ip] = &client{limiter: rate.NewLimiter(2, 5)}
-	   }
-   // Update the last seem for the client
- clients[ip].lastSeen = time.Now()
-
- // Check the rate limit status
-  if !clients[ip].limiter.Allow() {
-	  mu.Unlock()        // no longer need exclusive access to the map
-	  a.rateLimitExceededResponse(w, r)
-	  return
-  }
- 
-  mu.Unlock()   
-	   }   // others are free to get exclusive access to the map
-  next.ServeHTTP(w, r)
- })
- 
- }
- 
-   
-	
 
+		requestID := r.Header.Get("X-Request-Id")
+		if !requestIDRX.MatchString(requestID) || !fromTrustedProxy(r, a.config.limiter.trustedProxies) {
+			randomBytes := make([]byte, 16)
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			requestID = hex.EncodeToString(randomBytes)
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		ctx := data.ContextWithActor(r.Context(), data.Actor{ClientIP: ip, RequestID: requestID})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rateLimit applies the per-client token bucket of the request's class
+// (reads or writes) and reports the client's quota in RateLimit-* headers.
+// Clients are told apart by the address identifyRequest found.
+func (a *applicationDependencies) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.config.limiter.enabled {
+			ip := data.ActorFromContext(r.Context()).ClientIP
+			class := limitClassFor(r)
+			decision, err := a.limiter.Allow(r.Context(), class+":"+ip, a.limitRules[class])
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			decision.SetHeaders(w.Header())
+			if !decision.Allowed {
+				a.rateLimitExceededResponse(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate resolves an "Authorization: Bearer <token>" header into a
+// user stored on the request context. Requests without the header carry
+// data.AnonymousUser; a malformed, unknown or expired token is rejected.
+func (a *applicationDependencies) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on who is asking, so caches must key on it
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			r = a.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			a.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+		token := headerParts[1]
+
+		v := validator.New()
+		data.ValidateTokenPlaintext(v, token)
+		if !v.IsEmpty() {
+			a.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := a.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				a.invalidAuthenticationTokenResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = a.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthenticatedUser rejects anonymous requests with 401.
+func (a *applicationDependencies) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := a.contextGetUser(r)
+		if user.IsAnonymous() {
+			a.authenticationRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireActivatedUser rejects anonymous requests with 401 and requests from
+// users who have not activated their account with 403.
+func (a *applicationDependencies) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := a.contextGetUser(r)
+		if !user.Activated {
+			a.inactiveAccountResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return a.requireAuthenticatedUser(fn)
+}
+
+// requirePermission rejects requests from users who have not been granted
+// the permission code with 403. It implies requireActivatedUser.
+func (a *applicationDependencies) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := a.contextGetUser(r)
+		permissions, err := a.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include(code) {
+			a.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return a.requireActivatedUser(fn)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/migrations"
+)
+
+// runMigrate implements the "migrate up|down [N]|status|goto N" command.
+func runMigrate(db *sql.DB, logger *slog.Logger, args []string) error {
+	migrator, err := data.NewMigrator(db, migrations.Files)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [N]|status|goto N")
+	}
+
+	ctx := context.Background()
+	var done []data.MigrationStep
+
+	switch args[0] {
+	case "up":
+		done, err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err = migrator.Down(ctx, steps)
+	case "goto":
+		if len(args) < 2 {
+			return errors.New("usage: migrate goto N")
+		}
+		target, perr := strconv.ParseInt(args[1], 10, 64)
+		if perr != nil || target < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		done, err = migrator.Goto(ctx, target)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.AppliedAt != nil {
+				fmt.Printf("%06d_%s\tapplied %s\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%06d_%s\tpending\n", s.Version, s.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	for _, step := range done {
+		logMigrationStep(logger, step, "command", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info("database schema migrated", "version", version, "latest", migrator.Latest())
+	return nil
+}
+
+// checkSchema refuses to continue when the database is behind the embedded
+// migrations, unless autoMigrate is set, in which case it brings it up to
+// date first.
+func checkSchema(db *sql.DB, logger *slog.Logger, autoMigrate bool) error {
+	migrator, err := data.NewMigrator(db, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = migrator.Check(ctx)
+	if err == nil || !errors.Is(err, data.ErrSchemaBehind) {
+		return err
+	}
+	if !autoMigrate {
+		return fmt.Errorf("%w (run \"migrate up\" or start with -db-automigrate)", err)
+	}
+
+	done, err := migrator.Up(ctx)
+	for _, step := range done {
+		logMigrationStep(logger, step)
+	}
+	return err
+}
+
+// logMigrationStep logs a migration that was applied or rolled back, with
+// its direction, so that rollbacks stand out from upgrades.
+func logMigrationStep(logger *slog.Logger, step data.MigrationStep, args ...any) {
+	message := "migration applied"
+	if !step.Up {
+		message = "migration rolled back"
+	}
+	args = append(args, "direction", step.Direction(), "version", step.Version, "name", step.Name)
+	logger.Info(message, args...)
+}
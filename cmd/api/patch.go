@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/martinezmoises/Test1/internal/jsonpatch"
+)
+
+// Media types accepted by PATCH endpoints. Plain JSON is a partial document
+// whose null members are ignored.
+const (
+	mediaTypeJSON       = "application/json"
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// maxPatchBytes bounds the body of a merge patch or JSON Patch, which are
+// more verbose than the plain JSON bodies read by readJSON.
+const maxPatchBytes = 4096
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// readOnlyFieldsError lists the read-only fields a patch tried to change.
+type readOnlyFieldsError []string
+
+func (e readOnlyFieldsError) Error() string {
+	return fmt.Sprintf("read-only fields cannot be changed: %v", []string(e))
+}
+
+// patchMediaType returns the media type of a PATCH body, treating a missing
+// Content-Type as plain JSON, or errUnsupportedMediaType.
+func patchMediaType(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return mediaTypeJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !slices.Contains([]string{mediaTypeJSON, mediaTypeMergePatch, mediaTypeJSONPatch}, mediaType) {
+		return "", errUnsupportedMediaType
+	}
+	return mediaType, nil
+}
+
+// readPatch reads a merge patch or JSON Patch body of the given media type
+// and applies it to the JSON representation of current. The writable
+// members of the result are decoded into destination, a pointer to a
+// zeroed resource, so that members the patch removed come out as zero
+// values. Changes to any other member fail with readOnlyFieldsError, and a
+// failed JSON Patch test with jsonpatch.ErrTestFailed.
+func (a *applicationDependencies) readPatch(w http.ResponseWriter, r *http.Request, mediaType string, current any, writable []string, destination any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxPatchBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf("the body must not be larger that %d bytes", maxBytesError.Limit)
+		}
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errors.New("the body must not be empty")
+	}
+
+	encoded, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	original, err := jsonpatch.Decode(encoded)
+	if err != nil {
+		return err
+	}
+
+	var patched any
+	switch mediaType {
+	case mediaTypeMergePatch:
+		patch, err := jsonpatch.Decode(body)
+		if err != nil {
+			return fmt.Errorf("the body contains badly-formed JSON: %w", err)
+		}
+		patched = jsonpatch.MergePatch(original, patch)
+	case mediaTypeJSONPatch:
+		operations, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return err
+		}
+		patched, err = jsonpatch.Apply(original, operations)
+		if err != nil {
+			return err
+		}
+	default:
+		return errUnsupportedMediaType
+	}
+
+	patchedObject, ok := patched.(map[string]any)
+	if !ok {
+		return errors.New("the patched document must be a JSON object")
+	}
+	originalObject := original.(map[string]any)
+
+	// Only writable members may differ; new members are unknown fields
+	var readOnly []string
+	for name, value := range patchedObject {
+		if slices.Contains(writable, name) {
+			continue
+		}
+		before, ok := originalObject[name]
+		if !ok {
+			return fmt.Errorf("body contains unknown key %q", name)
+		}
+		if !jsonpatch.Equal(before, value) {
+			readOnly = append(readOnly, name)
+		}
+	}
+	for name := range originalObject {
+		if _, ok := patchedObject[name]; !ok && !slices.Contains(writable, name) {
+			readOnly = append(readOnly, name)
+		}
+	}
+	if len(readOnly) > 0 {
+		sort.Strings(readOnly)
+		return readOnlyFieldsError(readOnly)
+	}
+
+	fields := make(map[string]any, len(writable))
+	for _, name := range writable {
+		if value, ok := patchedObject[name]; ok {
+			fields[name] = value
+		}
+	}
+	encoded, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(encoded, destination)
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		if errors.As(err, &unmarshalTypeError) {
+			return fmt.Errorf("the patched document has the incorrect JSON type for field %q", unmarshalTypeError.Field)
+		}
+		return err
+	}
+	return nil
+}
+
+// patchErrorResponse answers a request whose patch could not be applied.
+func (a *applicationDependencies) patchErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var readOnly readOnlyFieldsError
+	switch {
+	case errors.Is(err, errUnsupportedMediaType):
+		a.unsupportedMediaTypeResponse(w, r)
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		a.patchTestFailedResponse(w, r, err)
+	case errors.As(err, &readOnly):
+		errs := make(map[string]string, len(readOnly))
+		for _, name := range readOnly {
+			errs[name] = "is read-only"
+		}
+		a.failedValidationResponse(w, r, errs)
+	default:
+		a.badRequestResponse(w, r, err)
+	}
+}
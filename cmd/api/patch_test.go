@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/martinezmoises/Test1/internal/data"
+)
+
+func TestUpdateProductPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		errorFields []string // members of a validation error
+		want        data.Product
+	}{
+		{
+			name:        "merge patch",
+			contentType: mediaTypeMergePatch,
+			body:        `{"price": 60, "image_url": null}`,
+			status:      http.StatusOK,
+			want:        data.Product{Name: "Chair", Description: "Wooden", Category: "furniture", Price: 60},
+		},
+		{
+			name:        "merge patch leaving read-only fields as they are",
+			contentType: mediaTypeMergePatch,
+			body:        `{"name": "Stool", "review_count": 0, "version": 1}`,
+			status:      http.StatusOK,
+			want:        data.Product{Name: "Stool", Description: "Wooden", Category: "furniture", Price: 50, ImageURL: "chair.png"},
+		},
+		{
+			name:        "merge patch removing a required field",
+			contentType: mediaTypeMergePatch,
+			body:        `{"name": null}`,
+			status:      http.StatusUnprocessableEntity,
+			errorFields: []string{"name"},
+		},
+		{
+			name:        "merge patch changing read-only fields",
+			contentType: mediaTypeMergePatch,
+			body:        `{"price": 60, "review_count": 3, "average_rating": 5}`,
+			status:      http.StatusUnprocessableEntity,
+			errorFields: []string{"average_rating", "review_count"},
+		},
+		{
+			name:        "merge patch with an unknown field",
+			contentType: mediaTypeMergePatch,
+			body:        `{"colour": "red"}`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "merge patch with a field of the wrong type",
+			contentType: mediaTypeMergePatch,
+			body:        `{"price": "cheap"}`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "merge patch replacing the whole document",
+			contentType: mediaTypeMergePatch,
+			body:        `["Chair"]`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "JSON Patch",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "test", "path": "/price", "value": 50}, {"op": "replace", "path": "/price", "value": 55}, {"op": "move", "from": "/image_url", "path": "/description"}]`,
+			status:      http.StatusOK,
+			want:        data.Product{Name: "Chair", Description: "chair.png", Category: "furniture", Price: 55},
+		},
+		{
+			name:        "JSON Patch with a null value",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/image_url", "value": null}]`,
+			status:      http.StatusOK,
+			want:        data.Product{Name: "Chair", Description: "Wooden", Category: "furniture", Price: 50},
+		},
+		{
+			name:        "JSON Patch with a failed test",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/price", "value": 55}, {"op": "test", "path": "/price", "value": 50}]`,
+			status:      http.StatusConflict,
+		},
+		{
+			name:        "JSON Patch testing a read-only field",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "test", "path": "/review_count", "value": 1}, {"op": "replace", "path": "/price", "value": 55}]`,
+			status:      http.StatusConflict,
+		},
+		{
+			name:        "JSON Patch removing a read-only field",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "remove", "path": "/average_rating"}]`,
+			status:      http.StatusUnprocessableEntity,
+			errorFields: []string{"average_rating"},
+		},
+		{
+			name:        "JSON Patch replacing the version",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "replace", "path": "/version", "value": 7}]`,
+			status:      http.StatusUnprocessableEntity,
+			errorFields: []string{"version"},
+		},
+		{
+			name:        "JSON Patch adding an escaped member",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "add", "path": "/image~1url", "value": "x.png"}]`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "JSON Patch with an unknown op",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "increment", "path": "/price", "value": 1}]`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "JSON Patch removing a missing member",
+			contentType: mediaTypeJSONPatch,
+			body:        `[{"op": "remove", "path": "/colour"}]`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "text/plain",
+			body:        `price=60`,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a := &applicationDependencies{
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				models: data.NewMemoryModels(data.NewMemoryStore()),
+			}
+			product := &data.Product{Name: "Chair", Description: "Wooden", Category: "furniture", Price: 50, ImageURL: "chair.png"}
+			if err := a.models.Products.Insert(ctx, product); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/products/1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: "1"}}))
+			w := httptest.NewRecorder()
+			a.updateProductHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			var response struct {
+				Error   json.RawMessage `json:"error"`
+				Product data.Product    `json:"product"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errorFields != nil {
+				var errs map[string]string
+				if err := json.Unmarshal(response.Error, &errs); err != nil {
+					t.Fatalf("got error %s, want a validation error", response.Error)
+				}
+				var fields []string
+				for field := range errs {
+					fields = append(fields, field)
+				}
+				slices.Sort(fields)
+				if !slices.Equal(fields, tt.errorFields) {
+					t.Errorf("got errors for %v, want %v", fields, tt.errorFields)
+				}
+			}
+
+			// Patches that do not apply leave the product as it was
+			stored, err := a.models.Products.Get(ctx, product.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.status != http.StatusOK {
+				if stored.Version != product.Version || stored.Price != product.Price {
+					t.Errorf("got product %+v after a failed patch, want %+v", stored, product)
+				}
+				return
+			}
+
+			got := response.Product
+			if got.Name != tt.want.Name || got.Description != tt.want.Description || got.Category != tt.want.Category ||
+				got.Price != tt.want.Price || got.ImageURL != tt.want.ImageURL {
+				t.Errorf("got product %+v, want %+v", got, tt.want)
+			}
+			if got.Version != product.Version+1 || stored.Version != got.Version || stored.Price != got.Price {
+				t.Errorf("got version %d and stored product %+v, want version %d stored", got.Version, stored, product.Version+1)
+			}
+		})
+	}
+}
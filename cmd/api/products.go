@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/martinezmoises/Test1/internal/data"
 	"github.com/martinezmoises/Test1/internal/validator"
@@ -12,13 +13,13 @@ import (
 // Handler to create a new product
 func (a *applicationDependencies) createProductHandler(w http.ResponseWriter, r *http.Request) {
 	// Define a struct to hold the input data from the request body
+	// average_rating and review_count are computed from reviews, so they are not accepted here
 	var input struct {
-		Name          string  `json:"name"`
-		Description   string  `json:"description"`
-		Category      string  `json:"category"`
-		Price         float64 `json:"price"`
-		ImageURL      string  `json:"image_url"`
-		AverageRating float64 `json:"average_rating,omitempty"` // Optional field for initial rating
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		Category    string  `json:"category"`
+		Price       float64 `json:"price"`
+		ImageURL    string  `json:"image_url"`
 	}
 
 	// Read and decode the JSON body into the input struct
@@ -30,12 +31,11 @@ func (a *applicationDependencies) createProductHandler(w http.ResponseWriter, r
 
 	// Create a new Product struct with the input data
 	product := &data.Product{
-		Name:          input.Name,
-		Description:   input.Description,
-		Category:      input.Category,
-		Price:         input.Price,
-		ImageURL:      input.ImageURL,
-		AverageRating: input.AverageRating, // Initialize with the provided rating
+		Name:        input.Name,
+		Description: input.Description,
+		Category:    input.Category,
+		Price:       input.Price,
+		ImageURL:    input.ImageURL,
 	}
 
 	// Initialize a validator and validate the product data
@@ -47,14 +47,14 @@ func (a *applicationDependencies) createProductHandler(w http.ResponseWriter, r
 	}
 
 	// Insert the new product into the database
-	err = a.productModel.Insert(product)
+	err = a.models.Products.Insert(r.Context(), product)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
 	// Set the Location header for the newly created product and respond with JSON
-	headers := make(http.Header)
+	headers := validatorHeaders(productETag(product), product.UpdatedAt)
 	headers.Set("Location", fmt.Sprintf("/v1/products/%d", product.ID))
 	data := envelope{"product": product}
 	err = a.writeJSON(w, http.StatusCreated, data, headers)
@@ -72,8 +72,16 @@ func (a *applicationDependencies) displayProductHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Read the fields and include parameters before touching the database
+	v := validator.New()
+	shape := a.readProductShape(r.URL.Query(), v)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Retrieve the product from the database by ID
-	product, err := a.productModel.Get(id)
+	product, err := a.models.Products.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -84,14 +92,41 @@ func (a *applicationDependencies) displayProductHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Trim the representation or embed related resources as asked. Shaped
+	// representations get their own validators, see shapedValidatorHeaders
+	var representation any = product
+	headers := validatorHeaders(productETag(product), product.UpdatedAt)
+	if !shape.isZero() {
+		shaped, err := a.shapeProducts(r.Context(), []*data.Product{product}, shape)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		representation = shaped[0]
+		headers, err = shapedValidatorHeaders(representation, shape, product.UpdatedAt)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Answer with 304 Not Modified if the client's cached copy is current
+	if a.notModified(w, r, headers) {
+		return
+	}
+
 	// Respond with the product data in JSON format
-	data := envelope{"product": product}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	data := envelope{"product": representation}
+	err = a.writeJSON(w, http.StatusOK, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
 
+// productWritableFields are the members of a product representation that
+// a patch may change. average_rating and review_count follow the reviews.
+var productWritableFields = []string{"name", "description", "category", "price", "image_url"}
+
 // Handler to update a specific product by ID
 func (a *applicationDependencies) updateProductHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the product ID from the URL and handle errors
@@ -102,7 +137,7 @@ func (a *applicationDependencies) updateProductHandler(w http.ResponseWriter, r
 	}
 
 	// Retrieve the existing product from the database
-	product, err := a.productModel.Get(id)
+	product, err := a.models.Products.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -113,39 +148,73 @@ func (a *applicationDependencies) updateProductHandler(w http.ResponseWriter, r
 		return
 	}
 
-	// Define a struct to hold optional fields for partial updates
-	var input struct {
-		Name          *string  `json:"name"`
-		Description   *string  `json:"description"`
-		Category      *string  `json:"category"`
-		Price         *float64 `json:"price"`
-		ImageURL      *string  `json:"image_url"`
-		AverageRating *float64 `json:"average_rating,omitempty"` // Optional field to update the rating
+	// Reject the update early if the client was looking at a stale version
+	if !preconditionsMet(r, productETag(product), product.Version, product.UpdatedAt) {
+		a.preconditionFailedResponse(w, r)
+		return
 	}
-	err = a.readJSON(w, r, &input)
+	expectedVersion, ok, err := a.readExpectedVersion(r)
 	if err != nil {
 		a.badRequestResponse(w, r, err)
 		return
 	}
-
-	// Update the product fields if they are provided
-	if input.Name != nil {
-		product.Name = *input.Name
-	}
-	if input.Description != nil {
-		product.Description = *input.Description
-	}
-	if input.Category != nil {
-		product.Category = *input.Category
-	}
-	if input.Price != nil {
-		product.Price = *input.Price
+	if ok && expectedVersion != product.Version {
+		a.editConflictResponse(w, r)
+		return
 	}
-	if input.ImageURL != nil {
-		product.ImageURL = *input.ImageURL
+
+	// Apply the body: plain JSON sets the fields it provides, while merge
+	// patches and JSON Patches apply to the whole representation and can
+	// clear fields or test the current values
+	mediaType, err := patchMediaType(r)
+	if err != nil {
+		a.patchErrorResponse(w, r, err)
+		return
 	}
-	if input.AverageRating != nil {
-		product.AverageRating = *input.AverageRating
+	if mediaType == mediaTypeJSON {
+		// Define a struct to hold optional fields for partial updates.
+		// average_rating and review_count are read-only: they follow the reviews.
+		var input struct {
+			Name        *string  `json:"name"`
+			Description *string  `json:"description"`
+			Category    *string  `json:"category"`
+			Price       *float64 `json:"price"`
+			ImageURL    *string  `json:"image_url"`
+		}
+		err = a.readJSON(w, r, &input)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		// Update the product fields if they are provided
+		if input.Name != nil {
+			product.Name = *input.Name
+		}
+		if input.Description != nil {
+			product.Description = *input.Description
+		}
+		if input.Category != nil {
+			product.Category = *input.Category
+		}
+		if input.Price != nil {
+			product.Price = *input.Price
+		}
+		if input.ImageURL != nil {
+			product.ImageURL = *input.ImageURL
+		}
+	} else {
+		var patched data.Product
+		err = a.readPatch(w, r, mediaType, product, productWritableFields, &patched)
+		if err != nil {
+			a.patchErrorResponse(w, r, err)
+			return
+		}
+		product.Name = patched.Name
+		product.Description = patched.Description
+		product.Category = patched.Category
+		product.Price = patched.Price
+		product.ImageURL = patched.ImageURL
 	}
 
 	// Validate the updated product data
@@ -156,16 +225,21 @@ func (a *applicationDependencies) updateProductHandler(w http.ResponseWriter, r
 		return
 	}
 
-	// Update the product in the database
-	err = a.productModel.Update(product)
+	// Update the product in the database, failing if it changed since we read it
+	err = a.models.Products.Update(r.Context(), product)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	// Respond with the updated product data in JSON format
 	data := envelope{"product": product}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, validatorHeaders(productETag(product), product.UpdatedAt))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -180,8 +254,8 @@ func (a *applicationDependencies) deleteProductHandler(w http.ResponseWriter, r
 		return
 	}
 
-	// Delete the product from the database
-	err = a.productModel.Delete(id)
+	// Retrieve the product so the delete is conditional on the version we read
+	product, err := a.models.Products.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -192,6 +266,33 @@ func (a *applicationDependencies) deleteProductHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Refuse the delete if the client was looking at a stale version
+	if !preconditionsMet(r, productETag(product), product.Version, product.UpdatedAt) {
+		a.preconditionFailedResponse(w, r)
+		return
+	}
+	expectedVersion, ok, err := a.readExpectedVersion(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+	if ok && expectedVersion != product.Version {
+		a.editConflictResponse(w, r)
+		return
+	}
+
+	// Delete the product from the database
+	err = a.models.Products.Delete(r.Context(), product.ID, product.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	// Respond with a success message in JSON format
 	data := envelope{"message": "product successfully deleted"}
 	err = a.writeJSON(w, http.StatusOK, data, nil)
@@ -200,44 +301,298 @@ func (a *applicationDependencies) deleteProductHandler(w http.ResponseWriter, r
 	}
 }
 
+// Handler to restore a specific product from the trash, with the reviews
+// deleted along with it
+func (a *applicationDependencies) restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID from the URL and handle errors
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	product, err := a.models.Products.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Respond with the restored product data in JSON format
+	data := envelope{"product": product}
+	err = a.writeJSON(w, http.StatusOK, data, validatorHeaders(productETag(product), product.UpdatedAt))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to list the products in the trash, the latest deleted first
+func (a *applicationDependencies) listTrashedProductsHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse query parameters for pagination and sorting
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "-deleted_at")
+	filters.SortSafeList = data.ProductTrashSortSafeList
+	filters.Cursor = a.getCursorParameter(queryParameters, v)
+	filters.Count = a.getCountParameter(queryParameters, filters.Cursor)
+
+	// Validate filters and handle errors if necessary
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	products, metadata, err := a.models.Products.GetDeleted(r.Context(), filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	metadata.EncodeCursors(a.cursors)
+
+	// Respond with the deleted products and pagination metadata in JSON format
+	headers := validatorHeaders(productsETag(products, metadata, nil), time.Time{})
+	if a.notModified(w, r, headers) {
+		return
+	}
+	data := envelope{"products": products, "@metadata": metadata}
+	err = a.writeJSON(w, http.StatusOK, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// errPreconditionFailed aborts a transaction whose product no longer matches
+// the request's conditional headers.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// errMergeSourceNotFound aborts a merge whose source product does not exist.
+var errMergeSourceNotFound = errors.New("merge source not found")
+
+// Handler to merge a duplicate product into a specific product: the
+// duplicate's reviews move over and it is deleted, all or nothing
+func (a *applicationDependencies) mergeProductHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID from the URL and handle errors
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SourceID int64 `json:"source_id"`
+	}
+	err = a.readJSON(w, r, &input)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.SourceID > 0, "source_id", "must be a positive product ID")
+	v.Check(input.SourceID != id, "source_id", "must differ from the product merged into")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	expectedVersion, hasExpectedVersion, err := a.readExpectedVersion(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Move the reviews and delete the source in one transaction, so that a
+	// failure leaves both products as they were
+	var product *data.Product
+	var moved int
+	err = a.models.WithTx(r.Context(), func(tx data.Models) error {
+		target, err := tx.Products.Get(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if !preconditionsMet(r, productETag(target), target.Version, target.UpdatedAt) {
+			return errPreconditionFailed
+		}
+		if hasExpectedVersion && expectedVersion != target.Version {
+			return data.ErrEditConflict
+		}
+
+		source, err := tx.Products.Get(r.Context(), input.SourceID)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return errMergeSourceNotFound
+			}
+			return err
+		}
+		moved, err = tx.Reviews.Reassign(r.Context(), source.ID, target.ID)
+		if err != nil {
+			return err
+		}
+
+		// Moving the reviews only refreshed the ratings, so the source is
+		// still at the version read above
+		err = tx.Products.Delete(r.Context(), source.ID, source.Version)
+		if err != nil {
+			return err
+		}
+
+		product, err = tx.Products.Get(r.Context(), target.ID)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		case errors.Is(err, errMergeSourceNotFound):
+			a.failedValidationResponse(w, r, map[string]string{"source_id": "must be an existing product"})
+		case errors.Is(err, errPreconditionFailed):
+			a.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Respond with the merged product and how many reviews it gained
+	data := envelope{"product": product, "moved_reviews": moved}
+	err = a.writeJSON(w, http.StatusOK, data, validatorHeaders(productETag(product), product.UpdatedAt))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
 // Handler to list all products with filtering, sorting, and pagination
 func (a *applicationDependencies) listProductsHandler(w http.ResponseWriter, r *http.Request) {
 	// Define a struct to hold query parameters for filtering and pagination
 	var input struct {
-		Name     string
-		Category string
+		data.ProductFilter
 		data.Filters
 	}
 
 	// Parse query parameters from the URL
 	queryParameters := r.URL.Query()
-	input.Name = a.getSingleQueryParameter(queryParameters, "name", "")
-	input.Category = a.getSingleQueryParameter(queryParameters, "category", "")
-
-	// Initialize a validator and parse pagination/sorting parameters
 	v := validator.New()
+	input.ProductFilter.Query = a.getSingleQueryParameter(queryParameters, "q", "")
+	input.ProductFilter.Name = a.getSingleQueryParameter(queryParameters, "name", "")
+	input.ProductFilter.Categories = a.getCommaSeparatedParameter(queryParameters, "category")
+	input.ProductFilter.MinPrice = a.getSingleFloatParameter(queryParameters, "min_price", 0, v)
+	input.ProductFilter.MaxPrice = a.getSingleFloatParameter(queryParameters, "max_price", 0, v)
+	input.ProductFilter.MinRating = a.getSingleFloatParameter(queryParameters, "min_rating", 0, v)
+	input.ProductFilter.CreatedAfter = a.getSingleTimeParameter(queryParameters, "created_after", v)
+	input.ProductFilter.CreatedBefore = a.getSingleTimeParameter(queryParameters, "created_before", v)
+	input.ProductFilter.HasReviews = a.getSingleBoolParameter(queryParameters, "has_reviews", v)
+
+	// Parse pagination/sorting parameters
 	input.Filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
 	input.Filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
 	input.Filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "name", "-id", "-name", "price", "-price", "average_rating", "-average_rating"}
+	input.Filters.SortSafeList = data.ProductSortSafeList
+	if input.ProductFilter.Query != "" {
+		// Searches list the best matches first unless told otherwise
+		input.Filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "relevance")
+		input.Filters.SortSafeList = data.ProductSearchSortSafeList
+	}
+	input.Filters.Cursor = a.getCursorParameter(queryParameters, v)
+	input.Filters.Count = a.getCountParameter(queryParameters, input.Filters.Cursor)
+	facetNames := a.getCommaSeparatedParameter(queryParameters, "facets")
+	shape := a.readProductShape(queryParameters, v)
 
 	// Validate filters and handle errors if necessary
+	data.ValidateProductFilter(v, input.ProductFilter)
 	data.ValidateFilters(v, input.Filters)
+	data.ValidateFacets(v, facetNames)
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Retrieve the list of products with the specified filters
-	products, metadata, err := a.productModel.GetAll(input.Name, input.Category, input.Filters)
+	products, metadata, err := a.models.Products.GetAll(r.Context(), input.ProductFilter, input.Filters)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
+	metadata.EncodeCursors(a.cursors)
+
+	// Count the sidebar facets over the same filters
+	var facets data.Facets
+	if len(facetNames) > 0 {
+		facets, err = a.models.Products.Facets(r.Context(), input.ProductFilter, facetNames)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Trim the representations or embed related resources as asked
+	var representations any = products
+	headers := validatorHeaders(productsETag(products, metadata, facets), time.Time{})
+	if !shape.isZero() {
+		shaped, err := a.shapeProducts(r.Context(), products, shape)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		representations = shaped
+	}
+	data := envelope{"products": representations, "@metadata": metadata}
+	if facets != nil {
+		data["@facets"] = facets
+	}
+	if !shape.isZero() {
+		headers, err = shapedValidatorHeaders(data, shape, time.Time{})
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	// Respond with the list of products and pagination metadata in JSON format
-	data := envelope{"products": products, "@metadata": metadata}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if a.notModified(w, r, headers) {
+		return
+	}
+	err = a.writeJSON(w, http.StatusOK, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to complete a partially typed product name, for search boxes
+func (a *applicationDependencies) suggestProductsHandler(w http.ResponseWriter, r *http.Request) {
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	prefix := a.getSingleQueryParameter(queryParameters, "prefix", "")
+	limit := a.getSingleIntegerParameter(queryParameters, "limit", 8, v)
+
+	data.ValidateSuggestion(v, prefix, limit)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := a.models.Products.Suggest(r.Context(), prefix, limit)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Let browsers reuse completions while the user retypes a prefix
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=60")
+	data := envelope{"suggestions": suggestions}
+	err = a.writeJSON(w, http.StatusOK, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
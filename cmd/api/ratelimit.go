@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Rate limit classes. Requests that change state are limited more strictly
+// than reads.
+const (
+	limitClassRead  = "read"
+	limitClassWrite = "write"
+)
+
+// limitClassFor returns the rate limit class of a request.
+func limitClassFor(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return limitClassRead
+	default:
+		return limitClassWrite
+	}
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDR ranges or bare
+// IP addresses.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientIP returns the address of the client that made the request. When
+// the connection comes from a trusted proxy, X-Forwarded-For is walked from
+// the right, skipping further trusted proxies, and X-Real-IP is used as a
+// fallback. Headers from untrusted peers are ignored because they can be
+// forged.
+func clientIP(r *http.Request, trusted []*net.IPNet) (string, error) {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if !isTrusted(net.ParseIP(remote), trusted) {
+		return remote, nil
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !isTrusted(ip, trusted) {
+				return ip.String(), nil
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String(), nil
+	}
+	return remote, nil
+}
+
+// fromTrustedProxy reports whether the connection comes from a trusted
+// proxy, whose headers describe the client.
+func fromTrustedProxy(r *http.Request, trusted []*net.IPNet) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && isTrusted(net.ParseIP(remote), trusted)
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
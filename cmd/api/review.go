@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/martinezmoises/Test1/internal/data"
 	"github.com/martinezmoises/Test1/internal/validator"
@@ -18,10 +19,10 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	// Define a struct to hold the input data from the request body
+	// Define a struct to hold the input data from the request body.
+	// The author is the authenticated user, not something the client sends.
 	var input struct {
 		Content string `json:"content"`
-		Author  string `json:"author"`
 		Rating  int    `json:"rating"`
 	}
 
@@ -32,11 +33,15 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	// The route is wrapped in requireActivatedUser, so this is a real user
+	user := a.contextGetUser(r)
+
 	// Create a new Review struct with the provided input data and product ID
 	review := &data.Review{
 		ProductID: productID,
+		UserID:    user.ID,
 		Content:   input.Content,
-		Author:    input.Author,
+		Author:    user.Name,
 		Rating:    input.Rating,
 	}
 
@@ -48,15 +53,20 @@ func (a *applicationDependencies) createReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	// Insert the new review into the database
-	err = a.reviewModel.Insert(review)
+	// Insert the new review into the database; this also refreshes the product rating
+	err = a.models.Reviews.Insert(r.Context(), review)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	// Set the Location header for the newly created review and respond with JSON
-	headers := make(http.Header)
+	headers := validatorHeaders(reviewETag(review), review.UpdatedAt)
 	headers.Set("Location", fmt.Sprintf("/v1/products/%d/reviews/%d", productID, review.ID))
 	data := envelope{"review": review}
 	err = a.writeJSON(w, http.StatusCreated, data, headers)
@@ -73,14 +83,14 @@ func (a *applicationDependencies) displayReviewHandler(w http.ResponseWriter, r
 		a.notFoundResponse(w, r)
 		return
 	}
-	reviewID, err := a.readIDParam(r)
+	reviewID, err := a.readReviewIDParam(r)
 	if err != nil {
 		a.notFoundResponse(w, r)
 		return
 	}
 
 	// Retrieve the review from the database
-	review, err := a.reviewModel.Get(productID, reviewID)
+	review, err := a.models.Reviews.Get(r.Context(), productID, reviewID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -91,14 +101,28 @@ func (a *applicationDependencies) displayReviewHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Answer with 304 Not Modified if the client's cached copy is current
+	headers := validatorHeaders(reviewETag(review), review.UpdatedAt)
+	if a.notModified(w, r, headers) {
+		return
+	}
+
 	// Respond with the review data in JSON format
 	data := envelope{"review": review}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
 
+// reviewWritableFields are the members of a review representation that a
+// patch may change. The author is always the user who wrote it, and only
+// moderators may change the helpful count.
+var (
+	reviewWritableFields          = []string{"content", "rating"}
+	reviewModeratorWritableFields = []string{"content", "rating", "helpful_count"}
+)
+
 // Handler to update a specific review for a specific product
 func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract product ID and review ID from the URL
@@ -107,14 +131,14 @@ func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *
 		a.notFoundResponse(w, r)
 		return
 	}
-	reviewID, err := a.readIDParam(r)
+	reviewID, err := a.readReviewIDParam(r)
 	if err != nil {
 		a.notFoundResponse(w, r)
 		return
 	}
 
 	// Retrieve the existing review from the database
-	review, err := a.reviewModel.Get(productID, reviewID)
+	review, err := a.models.Reviews.Get(r.Context(), productID, reviewID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -125,33 +149,78 @@ func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	// Define a struct to hold optional fields for partial updates
-	var input struct {
-		Content      *string `json:"content"`
-		Author       *string `json:"author"`
-		Rating       *int    `json:"rating"`
-		HelpfulCount *int    `json:"helpful_count"`
+	// Only the author or a moderator may edit a review
+	moderator, ok := a.canModifyReview(w, r, review)
+	if !ok {
+		return
 	}
 
-	// Decode the JSON body into the input struct
-	err = a.readJSON(w, r, &input)
+	// Reject the update early if the client was looking at a stale version
+	if !preconditionsMet(r, reviewETag(review), review.Version, review.UpdatedAt) {
+		a.preconditionFailedResponse(w, r)
+		return
+	}
+	expectedVersion, ok, err := a.readExpectedVersion(r)
 	if err != nil {
 		a.badRequestResponse(w, r, err)
 		return
 	}
-
-	// Update the review fields if they are provided
-	if input.Content != nil {
-		review.Content = *input.Content
-	}
-	if input.Author != nil {
-		review.Author = *input.Author
+	if ok && expectedVersion != review.Version {
+		a.editConflictResponse(w, r)
+		return
 	}
-	if input.Rating != nil {
-		review.Rating = *input.Rating
+
+	// Apply the body like updateProductHandler does
+	mediaType, err := patchMediaType(r)
+	if err != nil {
+		a.patchErrorResponse(w, r, err)
+		return
 	}
-	if input.HelpfulCount != nil {
-		review.HelpfulCount = *input.HelpfulCount
+	if mediaType == mediaTypeJSON {
+		// Define a struct to hold optional fields for partial updates
+		var input struct {
+			Content      *string `json:"content"`
+			Rating       *int    `json:"rating"`
+			HelpfulCount *int    `json:"helpful_count"`
+		}
+
+		// Decode the JSON body into the input struct
+		err = a.readJSON(w, r, &input)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		// Update the review fields if they are provided
+		if input.Content != nil {
+			review.Content = *input.Content
+		}
+		if input.Rating != nil {
+			review.Rating = *input.Rating
+		}
+		if input.HelpfulCount != nil {
+			if !moderator {
+				a.failedValidationResponse(w, r, map[string]string{"helpful_count": "is read-only"})
+				return
+			}
+			review.HelpfulCount = *input.HelpfulCount
+		}
+	} else {
+		writable := reviewWritableFields
+		if moderator {
+			writable = reviewModeratorWritableFields
+		}
+		var patched data.Review
+		err = a.readPatch(w, r, mediaType, review, writable, &patched)
+		if err != nil {
+			a.patchErrorResponse(w, r, err)
+			return
+		}
+		review.Content = patched.Content
+		review.Rating = patched.Rating
+		if moderator {
+			review.HelpfulCount = patched.HelpfulCount
+		}
 	}
 
 	// Validate the updated review data
@@ -162,16 +231,21 @@ func (a *applicationDependencies) updateReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	// Update the review in the database
-	err = a.reviewModel.Update(review)
+	// Update the review in the database, failing if it changed since we read it
+	err = a.models.Reviews.Update(r.Context(), review)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	// Respond with the updated review data in JSON format
 	data := envelope{"review": review}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, validatorHeaders(reviewETag(review), review.UpdatedAt))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -185,14 +259,14 @@ func (a *applicationDependencies) deleteReviewHandler(w http.ResponseWriter, r *
 		a.notFoundResponse(w, r)
 		return
 	}
-	reviewID, err := a.readIDParam(r)
+	reviewID, err := a.readReviewIDParam(r)
 	if err != nil {
 		a.notFoundResponse(w, r)
 		return
 	}
 
-	// Delete the review from the database
-	err = a.reviewModel.Delete(productID, reviewID)
+	// Retrieve the review so the delete is conditional on the version we read
+	review, err := a.models.Reviews.Get(r.Context(), productID, reviewID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -203,6 +277,38 @@ func (a *applicationDependencies) deleteReviewHandler(w http.ResponseWriter, r *
 		return
 	}
 
+	// Only the author or a moderator may delete a review
+	if _, ok := a.canModifyReview(w, r, review); !ok {
+		return
+	}
+
+	// Refuse the delete if the client was looking at a stale version
+	if !preconditionsMet(r, reviewETag(review), review.Version, review.UpdatedAt) {
+		a.preconditionFailedResponse(w, r)
+		return
+	}
+	expectedVersion, ok, err := a.readExpectedVersion(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+	if ok && expectedVersion != review.Version {
+		a.editConflictResponse(w, r)
+		return
+	}
+
+	// Delete the review from the database
+	err = a.models.Reviews.Delete(r.Context(), productID, reviewID, review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	// Respond with a success message in JSON format
 	data := envelope{"message": "review successfully deleted"}
 	err = a.writeJSON(w, http.StatusOK, data, nil)
@@ -227,7 +333,9 @@ func (a *applicationDependencies) listReviewsForProductHandler(w http.ResponseWr
 	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
 	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
 	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "id")
-	filters.SortSafeList = []string{"id", "rating", "-id", "-rating"}
+	filters.SortSafeList = data.ReviewSortSafeList
+	filters.Cursor = a.getCursorParameter(queryParameters, v)
+	filters.Count = a.getCountParameter(queryParameters, filters.Cursor)
 
 	// Validate filters and handle errors if necessary
 	data.ValidateFilters(v, filters)
@@ -237,15 +345,21 @@ func (a *applicationDependencies) listReviewsForProductHandler(w http.ResponseWr
 	}
 
 	// Retrieve the list of reviews for the product with pagination and sorting
-	reviews, metadata, err := a.reviewModel.GetAll(productID, filters)
+	reviews, metadata, err := a.models.Reviews.GetAll(r.Context(), productID, filters)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
+	metadata.EncodeCursors(a.cursors)
+
 	// Respond with the list of reviews and pagination metadata in JSON format
+	headers := validatorHeaders(reviewsETag(reviews, metadata), time.Time{})
+	if a.notModified(w, r, headers) {
+		return
+	}
 	data := envelope{"reviews": reviews, "@metadata": metadata}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -260,7 +374,9 @@ func (a *applicationDependencies) listAllReviewsHandler(w http.ResponseWriter, r
 	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
 	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
 	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "id")
-	filters.SortSafeList = []string{"id", "rating", "-id", "-rating"}
+	filters.SortSafeList = data.ReviewSortSafeList
+	filters.Cursor = a.getCursorParameter(queryParameters, v)
+	filters.Count = a.getCountParameter(queryParameters, filters.Cursor)
 
 	// Validate filters and handle errors if necessary
 	data.ValidateFilters(v, filters)
@@ -270,16 +386,42 @@ func (a *applicationDependencies) listAllReviewsHandler(w http.ResponseWriter, r
 	}
 
 	// Retrieve all reviews with pagination and sorting, independent of product ID
-	reviews, metadata, err := a.reviewModel.GetAll(0, filters) // Passing 0 to indicate no specific product
+	reviews, metadata, err := a.models.Reviews.GetAll(r.Context(), 0, filters) // Passing 0 to indicate no specific product
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
+	metadata.EncodeCursors(a.cursors)
+
 	// Respond with the list of all reviews and pagination metadata in JSON format
+	headers := validatorHeaders(reviewsETag(reviews, metadata), time.Time{})
+	if a.notModified(w, r, headers) {
+		return
+	}
 	data := envelope{"reviews": reviews, "@metadata": metadata}
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
+
+// canModifyReview reports whether the current user wrote the review or holds
+// the reviews:moderate permission, and whether they are a moderator. When ok
+// is false a response has already been written.
+func (a *applicationDependencies) canModifyReview(w http.ResponseWriter, r *http.Request, review *data.Review) (moderator, ok bool) {
+	user := a.contextGetUser(r)
+	permissions, err := a.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return false, false
+	}
+	moderator = permissions.Include(data.PermissionReviewsModerate)
+
+	author := review.UserID != 0 && review.UserID == user.ID
+	if !author && !moderator {
+		a.notPermittedResponse(w, r)
+		return false, false
+	}
+	return moderator, true
+}
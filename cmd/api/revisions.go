@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// errRevisionNotFound aborts a revert to a version no revision produced.
+var errRevisionNotFound = errors.New("revision not found")
+
+// Handler to list the versions of a specific product, the latest first
+func (a *applicationDependencies) listProductVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID from the URL and handle errors
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	// Parse query parameters for pagination and sorting
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "-version")
+	filters.SortSafeList = data.ProductRevisionSortSafeList
+	filters.Cursor = a.getCursorParameter(queryParameters, v)
+	filters.Count = a.getCountParameter(queryParameters, filters.Cursor)
+
+	// Validate filters and handle errors if necessary
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The history of products in the trash is not shown
+	if !a.productExists(w, r, id) {
+		return
+	}
+
+	revisions, metadata, err := a.models.Revisions.GetAll(r.Context(), id, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	metadata.EncodeCursors(a.cursors)
+
+	// Respond with the versions and pagination metadata in JSON format
+	data := envelope{"versions": revisions, "@metadata": metadata}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to display a version of a specific product: the revision that
+// produced it and the product's fields at that point
+func (a *applicationDependencies) displayProductVersionHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID and the version from the URL
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+	version, err := a.readVersionParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	if !a.productExists(w, r, id) {
+		return
+	}
+
+	revision, snapshot, err := a.models.Revisions.Get(r.Context(), id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Respond with the revision and the fields it left the product with
+	data := envelope{"version": revision, "product": snapshot}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to compare two versions of a specific product field by field
+func (a *applicationDependencies) diffProductVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID from the URL and handle errors
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	from := a.getSingleIntegerParameter(queryParameters, "from", 0, v)
+	to := a.getSingleIntegerParameter(queryParameters, "to", 0, v)
+	v.Check(from > 0 && from <= math.MaxInt32, "from", "must be a positive version number")
+	v.Check(to > 0 && to <= math.MaxInt32, "to", "must be a positive version number")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !a.productExists(w, r, id) {
+		return
+	}
+
+	// Both versions must have been produced by revisions
+	snapshots := make(map[string]*data.ProductSnapshot, 2)
+	for name, version := range map[string]int{"from": from, "to": to} {
+		_, snapshot, err := a.models.Revisions.Get(r.Context(), id, int32(version))
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			v.AddError(name, "must be a version of the product")
+			continue
+		}
+		snapshots[name] = snapshot
+	}
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Respond with the fields that differ between the two versions
+	changes := data.DiffSnapshots(*snapshots["from"], *snapshots["to"])
+	data := envelope{"from": from, "to": to, "changes": changes}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to revert a specific product to the fields it had at an earlier
+// version, which creates a new version
+func (a *applicationDependencies) revertProductHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the product ID from the URL and handle errors
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	to := a.getSingleIntegerParameter(r.URL.Query(), "to", 0, v)
+	v.Check(to > 0 && to <= math.MaxInt32, "to", "must be a positive version number")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	expectedVersion, hasExpectedVersion, err := a.readExpectedVersion(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Read the product and the old fields and write them back in one
+	// transaction, so that the revert cannot overwrite a concurrent update
+	var product *data.Product
+	err = a.models.WithTx(r.Context(), func(tx data.Models) error {
+		var err error
+		product, err = tx.Products.Get(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if !preconditionsMet(r, productETag(product), product.Version, product.UpdatedAt) {
+			return errPreconditionFailed
+		}
+		if hasExpectedVersion && expectedVersion != product.Version {
+			return data.ErrEditConflict
+		}
+
+		_, snapshot, err := tx.Revisions.Get(r.Context(), id, int32(to))
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return errRevisionNotFound
+			}
+			return err
+		}
+		snapshot.Apply(product)
+		return tx.Products.Update(r.Context(), product)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		case errors.Is(err, errRevisionNotFound):
+			a.failedValidationResponse(w, r, map[string]string{"to": "must be a version of the product"})
+		case errors.Is(err, errPreconditionFailed):
+			a.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Respond with the reverted product data in JSON format
+	data := envelope{"product": product}
+	err = a.writeJSON(w, http.StatusOK, data, validatorHeaders(productETag(product), product.UpdatedAt))
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// productExists reports whether the product exists outside the trash. When
+// it returns false a response has already been written.
+func (a *applicationDependencies) productExists(w http.ResponseWriter, r *http.Request, id int64) bool {
+	_, err := a.models.Products.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/martinezmoises/Test1/internal/data"
 )
 
 func (a *applicationDependencies) routes() http.Handler {
@@ -16,19 +17,34 @@ func (a *applicationDependencies) routes() http.Handler {
 	router.MethodNotAllowed = http.HandlerFunc(a.methodNotAllowedResponse)
 	// setup routes
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", a.healthCheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/products", a.createProductHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/products/:id", a.displayProductHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/products/:id", a.updateProductHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/products/:id", a.deleteProductHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products", a.requirePermission(data.PermissionProductsWrite, a.idempotent(a.createProductHandler)))
+	// httprouter cannot register /v1/products/suggest beside /v1/products/:id
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id", a.staticParam("id", "suggest", a.suggestProductsHandler, a.displayProductHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/products/:id", a.requirePermission(data.PermissionProductsWrite, a.updateProductHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/products/:id", a.requirePermission(data.PermissionProductsWrite, a.deleteProductHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/merge", a.requirePermission(data.PermissionProductsWrite, a.mergeProductHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/restore", a.requirePermission(data.PermissionProductsWrite, a.restoreProductHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/trash/products", a.requirePermission(data.PermissionProductsWrite, a.listTrashedProductsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/versions", a.listProductVersionsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/versions/:version", a.displayProductVersionHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/diff", a.diffProductVersionsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/revert", a.requirePermission(data.PermissionProductsWrite, a.revertProductHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/products", a.listProductsHandler)
-	//Reviews Routes
-	router.HandlerFunc(http.MethodPost, "/v1/products/:id/reviews", a.createReviewHandler)
+	//Reviews Routes (editing and deleting is limited to the author or a
+	// reviews:moderate holder inside the handlers)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/reviews", a.requirePermission(data.PermissionReviewsWrite, a.idempotent(a.createReviewHandler)))
 	router.HandlerFunc(http.MethodGet, "/v1/products/:id/reviews", a.listReviewsForProductHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/products/:id/reviews/:review_id", a.displayReviewHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/products/:id/reviews/:review_id", a.updateReviewHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/products/:id/reviews/:review_id", a.deleteReviewHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/products/:id/reviews/:review_id", a.requireActivatedUser(a.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/products/:id/reviews/:review_id", a.requireActivatedUser(a.deleteReviewHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/reviews", a.listAllReviewsHandler)
+	//Users Routes
+	router.HandlerFunc(http.MethodPost, "/v1/users", a.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", a.activateUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", a.createAuthenticationTokenHandler)
+	//Admin Routes
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", a.requirePermission(data.PermissionAuditRead, a.listAuditEventsHandler))
 
-	return a.recoverPanic(a.rateLimit(router))
+	return a.recoverPanic(a.identifyRequest(a.rateLimit(a.authenticate(router))))
 
 }
@@ -5,6 +5,7 @@ import (
     "errors"
     "fmt"
     "log/slog"
+    "net"
     "net/http"
     "os"
     "os/signal"
@@ -12,6 +13,11 @@ import (
     "time"
 )
 func (a *applicationDependencies) serve() error {
+    // Request contexts derive from this one, which is cancelled once the
+    // shutdown grace period has passed, so that their queries stop
+    baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+    defer cancelRequests(nil)
+
     apiServer := &http.Server{
         Addr:         fmt.Sprintf(":%d", a.config.port),  // Use a.config instead of a.settings
         Handler:      a.routes(),
@@ -19,11 +25,16 @@ func (a *applicationDependencies) serve() error {
         ReadTimeout:  5 * time.Second,
         WriteTimeout: 10 * time.Second,
         ErrorLog:     slog.NewLogLogger(a.logger.Handler(), slog.LevelError),
+        BaseContext:  func(net.Listener) context.Context { return baseCtx },
     }
 
     // Create a channel to track errors during the shutdown process
     shutdownError := make(chan error)
 
+    // Delete expired idempotency keys until the server shuts down
+    stopCleanup := make(chan struct{})
+    go a.cleanupIdempotencyKeys(time.Hour, stopCleanup)
+
     // Goroutine to listen for shutdown signals
     go func() {
         quit := make(chan os.Signal, 1)
@@ -38,7 +49,21 @@ func (a *applicationDependencies) serve() error {
         defer cancel()
 
         // Send the shutdown error if it occurs
-        shutdownError <- apiServer.Shutdown(ctx)
+        err := apiServer.Shutdown(ctx)
+        // Stop whatever is still running past the grace period
+        cancelRequests(errShuttingDown)
+        // Stop the rate limiter's cleanup goroutine and close its connections
+        a.limiter.Close()
+        close(stopCleanup)
+        if err != nil {
+            shutdownError <- err
+            return
+        }
+
+        // Wait for background tasks such as sending email to finish
+        a.logger.Info("completing background tasks", "address", apiServer.Addr)
+        a.wg.Wait()
+        shutdownError <- nil
     }()
 
     // Start the server
@@ -59,3 +84,7 @@ func (a *applicationDependencies) serve() error {
 
     return nil
 }
+
+// errShuttingDown is the cause of the cancellation of requests still running
+// when the graceful shutdown period ends.
+var errShuttingDown = errors.New("server shutting down")
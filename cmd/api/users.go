@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/data"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// Handler to register a new (not yet activated) user account
+func (a *applicationDependencies) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Define a struct to hold the input data from the request body
+	var input struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	// Read and decode the JSON body into the input struct
+	err := a.readJSON(w, r, &input)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Check the plaintext password before hashing it, since bcrypt fails on
+	// passwords longer than 72 bytes
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Create a new User struct; the password is stored as a bcrypt hash
+	user := &data.User{
+		Name:      input.Name,
+		Email:     input.Email,
+		Activated: false,
+	}
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Validate the rest of the user data
+	data.ValidateUser(v, user)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Insert the new user, grant its permissions and issue its activation
+	// token in one transaction, so that a failure leaves no half-registered
+	// account behind to block the email address
+	var token *data.Token
+	err = a.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// Every new user may read products and write their own reviews
+		err = tx.Permissions.AddForUser(r.Context(), user.ID, data.DefaultPermissions...)
+		if err != nil {
+			return err
+		}
+
+		// Issue a single-use activation token valid for three days
+		token, err = tx.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Email the token in the background so the client is not kept waiting
+	responseData := envelope{"user": user}
+	if a.mailer != nil {
+		a.background(func() {
+			emailData := map[string]any{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+				"name":            user.Name,
+			}
+			err := a.mailer.Send(user.Email, "user_welcome.tmpl", emailData)
+			if err != nil {
+				a.logger.Error(err.Error(), "user_id", user.ID)
+			}
+		})
+	} else if a.config.environment == "development" {
+		// Without email delivery there is no other way to obtain the token locally
+		responseData["activation_token"] = token
+	}
+
+	err = a.writeJSON(w, http.StatusAccepted, responseData, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// Handler to activate a user account with an activation token
+func (a *applicationDependencies) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Define a struct to hold the plaintext activation token
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := a.readJSON(w, r, &input)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Look up the user the token was issued to
+	user, err := a.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Activate the user
+	user.Activated = true
+	err = a.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Activation tokens are single use
+	err = a.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{"user": user}
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -7,4 +7,6 @@ require (
 	github.com/lib/pq v1.10.9
 )
 
-require golang.org/x/time v0.7.0 // indirect
+require golang.org/x/time v0.7.0
+
+require golang.org/x/crypto v0.31.0
@@ -0,0 +1,25 @@
+package data
+
+import "context"
+
+// Actor identifies who makes a change, and through which request, for the
+// records the models keep of changes. Handlers pass it down in the context
+// of their operations.
+type Actor struct {
+	UserID    int64  // 0 when no user is involved, as in admin commands
+	ClientIP  string // empty outside HTTP requests
+	RequestID string // empty outside HTTP requests
+}
+
+type actorContextKey struct{}
+
+// ContextWithActor returns a copy of ctx carrying actor.
+func ContextWithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the actor carried by ctx, or the zero Actor.
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(Actor)
+	return actor
+}
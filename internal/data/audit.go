@@ -0,0 +1,308 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// Audited resources
+const (
+	AuditResourceProduct = "product"
+	AuditResourceReview  = "review"
+)
+
+// Audited actions. Deletes move records to the trash; purges remove them
+// for good.
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionPurge   = "purge"
+)
+
+// AuditResources and AuditActions list the values audit events can have.
+var (
+	AuditResources = []string{AuditResourceProduct, AuditResourceReview}
+	AuditActions   = []string{AuditActionCreate, AuditActionUpdate, AuditActionDelete, AuditActionRestore, AuditActionPurge}
+)
+
+// AuditEvent records a write to a product or a review: who made it, from
+// where and through which request, and the record as it was before and
+// after, in its JSON representation. Before is absent for creates and after
+// for deletes and purges. Events are written by the product and review
+// stores in the transaction of the write, and never change.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    int64           `json:"actor_id,omitempty"`
+	ClientIP   string          `json:"client_ip,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Resource   string          `json:"resource"`
+	ResourceID int64           `json:"resource_id"`
+	Action     string          `json:"action"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter restricts an audit log listing. Zero-valued fields do not
+// restrict it.
+type AuditFilter struct {
+	ActorID       int64
+	Resource      string
+	ResourceID    int64
+	Action        string
+	RequestID     string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// ValidateAuditFilter checks the values of an audit log filter. Errors are
+// keyed by query parameter.
+func ValidateAuditFilter(v *validator.Validator, filter AuditFilter) {
+	v.Check(filter.ActorID >= 0, "actor_id", "must not be negative")
+	v.Check(filter.ResourceID >= 0, "resource_id", "must not be negative")
+	if filter.Resource != "" {
+		v.Check(validator.PermittedValue(filter.Resource, AuditResources...), "resource", "must be one of "+strings.Join(AuditResources, ", "))
+	}
+	if filter.Action != "" {
+		v.Check(validator.PermittedValue(filter.Action, AuditActions...), "action", "must be one of "+strings.Join(AuditActions, ", "))
+	}
+	v.Check(len(filter.RequestID) <= 200, "request_id", "must not be more than 200 characters long")
+	if !filter.CreatedAfter.IsZero() && !filter.CreatedBefore.IsZero() {
+		v.Check(filter.CreatedBefore.After(filter.CreatedAfter), "created_before", "must be later than created_after")
+	}
+}
+
+// where returns the condition selecting the events that pass the filter,
+// with placeholders numbered from $1, and their arguments.
+func (f AuditFilter) where() (string, []any) {
+	conditions := []string{"TRUE"}
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.ActorID > 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Resource != "" {
+		add("resource = $%d", f.Resource)
+	}
+	if f.ResourceID > 0 {
+		add("resource_id = $%d", f.ResourceID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.RequestID != "" {
+		add("request_id = $%d", f.RequestID)
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at > $%d", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at < $%d", f.CreatedBefore)
+	}
+	return strings.Join(conditions, "\n\t\tAND "), args
+}
+
+// matches reports whether event passes the filter, like where.
+func (f AuditFilter) matches(event *AuditEvent) bool {
+	return (f.ActorID == 0 || event.ActorID == f.ActorID) &&
+		(f.Resource == "" || event.Resource == f.Resource) &&
+		(f.ResourceID == 0 || event.ResourceID == f.ResourceID) &&
+		(f.Action == "" || event.Action == f.Action) &&
+		(f.RequestID == "" || event.RequestID == f.RequestID) &&
+		(f.CreatedAfter.IsZero() || event.CreatedAt.After(f.CreatedAfter)) &&
+		(f.CreatedBefore.IsZero() || event.CreatedAt.Before(f.CreatedBefore))
+}
+
+// AuditStore is the set of operations the handlers need from an audit log
+// storage backend. AuditModel (PostgreSQL) and MemoryAuditModel both
+// satisfy it. Events are written by the product and review stores.
+type AuditStore interface {
+	// GetAll lists the events that pass the filter with sorting and
+	// pagination.
+	GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error)
+	// Export calls fn with every event that passes the filter, oldest
+	// first, and stops at the first error fn returns.
+	Export(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error
+}
+
+// AuditModel struct wraps the DB connection pool, or a transaction.
+type AuditModel struct {
+	DB       DBTX
+	Timeouts QueryTimeouts
+}
+
+// auditJSON encodes a record for an audit event; nil stays absent.
+func auditJSON(record any) (json.RawMessage, error) {
+	if record == nil {
+		return nil, nil
+	}
+	return json.Marshal(record)
+}
+
+// insertAuditEvent records a write made by the actor of ctx. before and
+// after are the record before and after the write, or nil.
+func insertAuditEvent(ctx context.Context, tx *sql.Tx, resource string, resourceID int64, action string, before, after any) error {
+	query := `
+		INSERT INTO audit_events (actor_id, client_ip, request_id, resource, resource_id, action, before, after)
+		VALUES (NULLIF($1::bigint, 0), NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7::jsonb, $8::jsonb)
+	`
+	args := []any{nil, nil}
+	for i, record := range []any{before, after} {
+		encoded, err := auditJSON(record)
+		if err != nil {
+			return err
+		}
+		if encoded != nil {
+			args[i] = string(encoded)
+		}
+	}
+	actor := ActorFromContext(ctx)
+	_, err := tx.ExecContext(ctx, query, actor.UserID, actor.ClientIP, actor.RequestID, resource, resourceID, action, args[0], args[1])
+	return err
+}
+
+const auditColumns = "id, created_at, COALESCE(actor_id, 0), COALESCE(client_ip, ''), COALESCE(request_id, ''), resource, resource_id, action, before, after"
+
+// scanAuditEvent reads a row of auditColumns, after the leading
+// destinations.
+func scanAuditEvent(rows *sql.Rows, leading ...any) (*AuditEvent, error) {
+	var event AuditEvent
+	var before, after []byte
+	err := rows.Scan(append(leading,
+		&event.ID,
+		&event.CreatedAt,
+		&event.ActorID,
+		&event.ClientIP,
+		&event.RequestID,
+		&event.Resource,
+		&event.ResourceID,
+		&event.Action,
+		&before,
+		&after,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	event.Before, event.After = before, after
+	return &event, nil
+}
+
+// GetAll lists the audit events that pass the filter with sorting and
+// pagination.
+func (m AuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	where, args := filter.where()
+
+	ctx, cancel := m.Timeouts.list(ctx)
+	defer cancel()
+
+	// See ProductModel.GetAll
+	total := "0"
+	totalRecords := 0
+	if filters.windowCount() {
+		total = "COUNT(*) OVER()"
+	} else if filters.Count != CountNone {
+		var err error
+		totalRecords, err = countRows(ctx, m.DB, "audit_events", where, args, filters.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	offset := filters.offset()
+	if !filters.Cursor.IsZero() {
+		condition, cursorArgs := filters.keysetCondition(len(args) + 1)
+		where += " AND " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+	args = append(args, filters.limit(), offset)
+
+	query := fmt.Sprintf(`
+		SELECT %s, %s
+		FROM audit_events
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, auditColumns, where, filters.orderBy(), len(args)-1, len(args))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	windowTotal := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows, &windowTotal)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if filters.windowCount() {
+		totalRecords = windowTotal
+	}
+
+	events, metadata := buildPage(events, filters, totalRecords, auditSortValue)
+	return events, metadata, nil
+}
+
+// Export calls fn with every audit event that passes the filter, oldest
+// first. The events are streamed from a single query, which only ends with
+// ctx since exports can be large.
+func (m AuditModel) Export(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error {
+	where, args := filter.where()
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM audit_events
+		WHERE %s
+		ORDER BY id`, auditColumns, where)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// AuditSortSafeList maps the sort keys of audit log listings to columns.
+// Events are numbered in the order they were recorded.
+var AuditSortSafeList = map[string]string{
+	"id": "id",
+}
+
+// auditSortValue returns the value of a sort key for an audit event.
+func auditSortValue(event *AuditEvent, key string) string {
+	return strconv.FormatInt(event.ID, 10)
+}
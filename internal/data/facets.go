@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+// Facets of a product listing, which count the products in each category,
+// price range and rating band.
+const (
+	FacetCategory = "category"
+	FacetPrice    = "price"
+	FacetRating   = "rating"
+)
+
+// ProductFacetSafeList lists the facets clients may ask for.
+var ProductFacetSafeList = []string{FacetCategory, FacetPrice, FacetRating}
+
+// PriceFacetBounds splits prices into the ranges of the price facet:
+// below 25, 25 to 50, and so on up to 250 and above. A range includes its
+// lower bound and excludes its upper one.
+var PriceFacetBounds = []float64{25, 50, 100, 250}
+
+// RatingFacetThresholds are the bands of the rating facet, each counting
+// the products rated at least that much ("4 & up").
+var RatingFacetThresholds = []int{4, 3, 2, 1}
+
+// maxCategoryFacets bounds the number of categories in the category facet,
+// which lists the largest first.
+const maxCategoryFacets = 50
+
+// FacetCount is the number of products with a facet value. Price values
+// are ranges such as "25-50" or "250-", rating values are thresholds.
+type FacetCount struct {
+	Value string   `json:"value"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// Facets maps the requested facets to their counts.
+type Facets map[string][]FacetCount
+
+// ValidateFacets checks the names of the facets parameter.
+func ValidateFacets(v *validator.Validator, names []string) {
+	for _, name := range names {
+		v.Check(validator.PermittedValue(name, ProductFacetSafeList...), "facets", "must only contain "+strings.Join(ProductFacetSafeList, ", "))
+	}
+}
+
+// facetFilter returns the filter a facet is counted over: filter without
+// its own restriction, so that the counts show what choosing another value
+// would give.
+func facetFilter(filter ProductFilter, facet string) ProductFilter {
+	switch facet {
+	case FacetCategory:
+		filter.Categories = nil
+	case FacetPrice:
+		filter.MinPrice, filter.MaxPrice = 0, 0
+	case FacetRating:
+		filter.MinRating = 0
+	}
+	return filter
+}
+
+// priceFacetCounts returns the price ranges, with the counts of the
+// products in each as returned by width_bucket: index 0 holds the prices
+// below the first bound.
+func priceFacetCounts(counts []int) []FacetCount {
+	facet := make([]FacetCount, len(PriceFacetBounds)+1)
+	for i := range facet {
+		low := 0.0
+		if i > 0 {
+			low = PriceFacetBounds[i-1]
+		}
+		facet[i] = FacetCount{Value: strconv.FormatFloat(low, 'f', -1, 64) + "-", Min: &low, Count: counts[i]}
+		if i < len(PriceFacetBounds) {
+			high := PriceFacetBounds[i]
+			facet[i].Value += strconv.FormatFloat(high, 'f', -1, 64)
+			facet[i].Max = &high
+		}
+	}
+	return facet
+}
+
+// ratingFacetCounts returns the rating bands with their counts, in the
+// order of RatingFacetThresholds.
+func ratingFacetCounts(counts []int) []FacetCount {
+	facet := make([]FacetCount, len(RatingFacetThresholds))
+	for i, threshold := range RatingFacetThresholds {
+		low := float64(threshold)
+		facet[i] = FacetCount{Value: strconv.Itoa(threshold), Min: &low, Count: counts[i]}
+	}
+	return facet
+}
+
+// Facets counts the products passing filter by each of the named facets,
+// leaving out the facet's own restriction. A search is matched the same
+// way as by GetAll.
+func (p ProductModel) Facets(ctx context.Context, filter ProductFilter, names []string) (Facets, error) {
+	ctx, cancel := p.Timeouts.list(ctx)
+	defer cancel()
+
+	err := p.resolveSearch(ctx, &filter)
+	if err != nil {
+		return nil, err
+	}
+
+	facets := make(Facets)
+	for _, name := range names {
+		if _, done := facets[name]; done {
+			continue
+		}
+		from, where, args := facetFilter(filter, name).where(p.searchLanguage())
+
+		switch name {
+		case FacetCategory:
+			query := fmt.Sprintf(`
+				SELECT category, COUNT(*)
+				FROM %s
+				WHERE %s
+				GROUP BY category
+				ORDER BY COUNT(*) DESC, category
+				LIMIT %d`, from, where, maxCategoryFacets)
+			rows, err := p.DB.QueryContext(ctx, query, args...)
+			if err != nil {
+				return nil, err
+			}
+			facet := []FacetCount{}
+			for rows.Next() {
+				var count FacetCount
+				err := rows.Scan(&count.Value, &count.Count)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				facet = append(facet, count)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return nil, err
+			}
+			facets[name] = facet
+
+		case FacetPrice:
+			args = append(args, pq.Array(PriceFacetBounds))
+			query := fmt.Sprintf(`
+				SELECT width_bucket(price::float8, $%d::float8[]), COUNT(*)
+				FROM %s
+				WHERE %s
+				GROUP BY 1`, len(args), from, where)
+			rows, err := p.DB.QueryContext(ctx, query, args...)
+			if err != nil {
+				return nil, err
+			}
+			counts := make([]int, len(PriceFacetBounds)+1)
+			for rows.Next() {
+				var bucket, count int
+				err := rows.Scan(&bucket, &count)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				counts[bucket] = count
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return nil, err
+			}
+			facets[name] = priceFacetCounts(counts)
+
+		case FacetRating:
+			columns := make([]string, len(RatingFacetThresholds))
+			for i, threshold := range RatingFacetThresholds {
+				columns[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE average_rating >= %d)", threshold)
+			}
+			query := fmt.Sprintf(`
+				SELECT %s
+				FROM %s
+				WHERE %s`, strings.Join(columns, ", "), from, where)
+			counts := make([]int, len(RatingFacetThresholds))
+			targets := make([]any, len(counts))
+			for i := range counts {
+				targets[i] = &counts[i]
+			}
+			err := p.DB.QueryRowContext(ctx, query, args...).Scan(targets...)
+			if err != nil {
+				return nil, err
+			}
+			facets[name] = ratingFacetCounts(counts)
+		}
+	}
+	return facets, nil
+}
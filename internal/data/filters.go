@@ -1,26 +1,51 @@
 package data
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/martinezmoises/Test1/internal/validator"
 )
 
+// Ways of obtaining Metadata.TotalRecords. CountEstimated uses the query
+// planner's row estimate and CountNone skips counting altogether.
+const (
+	CountExact     = "exact"
+	CountEstimated = "estimated"
+	CountNone      = "none"
+)
+
 // Filters struct for pagination, sorting, and filtering options
 type Filters struct {
 	Page         int
 	PageSize     int
-	Sort         string
-	SortSafeList []string
+	Sort         string            // comma-separated keys, "-" prefixed when descending
+	SortSafeList map[string]string // sort keys clients may use, mapped to SQL columns
+	Cursor       Cursor            // when set, keyset pagination is used instead of Page
+	Count        string            // CountExact, CountEstimated or CountNone
 }
 
 // Metadata struct for pagination information
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	Count        string `json:"count,omitempty"` // how TotalRecords was obtained
+	HasMore      bool   `json:"has_more"`
+	Fuzzy        bool   `json:"fuzzy,omitempty"` // a search fell back to similar spellings
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
+
+	// Positions of the adjacent pages, turned into NextCursor and
+	// PrevCursor by EncodeCursors
+	next Cursor
+	prev Cursor
 }
 
 // ValidateFilters validates pagination and sorting filters
@@ -29,44 +54,168 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page <= 500, "page", "must be a maximum of 500")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+	_, err := parseSort(f.Sort, f.SortSafeList)
+	if err != nil {
+		v.AddError("sort", err.Error())
+	} else if !f.Cursor.IsZero() {
+		v.Check(f.Cursor.Sort == f.Sort && len(f.Cursor.Values) == len(f.sortKeys()), "cursor", "does not match the sort parameter")
+	}
+	v.Check(validator.PermittedValue(f.Count, CountExact, CountEstimated, CountNone), "count", "must be exact, estimated or none")
 }
 
-// calculateMetaData calculates metadata for pagination
-func calculateMetaData(totalRecords, currentPage, pageSize int) Metadata {
-	if totalRecords == 0 {
-		return Metadata{}
+// calculateMetaData calculates metadata for pagination. count is the mode
+// that produced totalRecords: the total and the last page are left out with
+// CountNone, and are approximate with CountEstimated. currentPage is 0 in
+// cursor mode, where page numbers do not apply.
+func calculateMetaData(totalRecords, currentPage, pageSize int, count string) Metadata {
+	if totalRecords == 0 && count == CountExact {
+		return Metadata{Count: count}
+	}
+
+	metadata := Metadata{
+		CurrentPage: currentPage,
+		PageSize:    pageSize,
+		Count:       count,
+	}
+	if currentPage > 0 {
+		metadata.FirstPage = 1
+	}
+	if count == CountNone {
+		return metadata
 	}
 
-	return Metadata{
-		CurrentPage:  currentPage,
-		PageSize:     pageSize,
-		FirstPage:    1,
-		LastPage:     (totalRecords + pageSize - 1) / pageSize,
-		TotalRecords: totalRecords,
+	metadata.TotalRecords = totalRecords
+	if currentPage > 0 {
+		metadata.LastPage = (totalRecords + pageSize - 1) / pageSize
 	}
+	return metadata
+}
+
+// maxSortKeys bounds the number of keys of a sort parameter.
+const maxSortKeys = 5
+
+// sortKey is one key of a sort parameter, such as "-price".
+type sortKey struct {
+	name       string // as used in the API
+	column     string // SQL column or expression
+	descending bool
 }
 
-// sortColumn returns the column name for sorting, validating its safety
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafeList {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// parseSort splits a comma-separated sort parameter into its keys, each
+// checked against safeList, which maps API names to SQL columns. The error
+// describes the first problem found.
+func parseSort(sort string, safeList map[string]string) ([]sortKey, error) {
+	parts := strings.Split(sort, ",")
+	if len(parts) > maxSortKeys {
+		return nil, fmt.Errorf("must not have more than %d keys", maxSortKeys)
+	}
+
+	keys := make([]sortKey, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		name := strings.TrimPrefix(part, "-")
+		if name == "" {
+			return nil, errors.New("must not contain empty keys")
+		}
+		column, ok := safeList[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort key %q", name)
+		}
+		key := sortKey{name: name, column: column, descending: part != name}
+
+		for _, previous := range keys {
+			switch {
+			case previous.name == name && previous.descending != key.descending:
+				return nil, fmt.Errorf("conflicting directions for sort key %q", name)
+			case previous.name == name:
+				return nil, fmt.Errorf("duplicate sort key %q", name)
+			case previous.column == column:
+				return nil, fmt.Errorf("sort keys %q and %q are the same", previous.name, name)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortKeys returns the keys of the listing order: those of the sort
+// parameter, then id to break ties so that the order is total, which keyset
+// pagination relies on. It panics on a sort parameter that ValidateFilters
+// would reject.
+func (f Filters) sortKeys() []sortKey {
+	keys, err := parseSort(f.Sort, f.SortSafeList)
+	if err != nil {
+		panic("unsafe sort parameter: " + f.Sort)
+	}
+	for i, key := range keys {
+		// Keys after id never come into play
+		if key.name == "id" {
+			return keys[:i+1]
 		}
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+	return append(keys, sortKey{name: "id", column: "id"})
 }
 
-// sortDirection returns the sorting direction (ASC or DESC)
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+// orderBy returns the ORDER BY list of the listing. A backward cursor reads
+// the listing in reverse.
+func (f Filters) orderBy() string {
+	var terms []string
+	for _, key := range f.sortKeys() {
+		direction := "ASC"
+		if key.descending != f.Cursor.Backward {
+			direction = "DESC"
+		}
+		terms = append(terms, key.column+" "+direction)
+	}
+	return strings.Join(terms, ", ")
+}
+
+// keysetCondition returns the WHERE condition selecting the rows past the
+// cursor, numbering its placeholders from $n, and the matching arguments.
+// Sort key values are passed as text and take the type of their column.
+func (f Filters) keysetCondition(n int) (string, []any) {
+	keys := f.sortKeys()
+	args := make([]any, len(keys))
+	alternatives := make([]string, len(keys))
+
+	// A row is past the cursor when it ties with the cursor on the first i
+	// keys and is past it on key i. That is "greater" for an ascending key
+	// read forward, and "smaller" for a descending one or a backward read.
+	for i, key := range keys {
+		args[i] = f.Cursor.Values[i]
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, fmt.Sprintf("%s = $%d", keys[j].column, n+j))
+		}
+		operator := ">"
+		if key.descending != f.Cursor.Backward {
+			operator = "<"
+		}
+		terms = append(terms, fmt.Sprintf("%s %s $%d", key.column, operator, n+i))
+		alternatives[i] = "(" + strings.Join(terms, " AND ") + ")"
 	}
-	return "ASC"
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// overFetch reports whether one row more than a page is read to find out
+// whether there is another page, which is the case unless an exact total of
+// a page-based listing tells.
+func (f Filters) overFetch() bool {
+	return !f.Cursor.IsZero() || f.Count != CountExact
 }
 
-// limit returns the number of records per page
+// windowCount reports whether the total is counted by the listing query
+// itself with COUNT(*) OVER(). That only works when the query sees every
+// filtered row, so not in cursor mode.
+func (f Filters) windowCount() bool {
+	return f.Cursor.IsZero() && f.Count == CountExact
+}
+
+// limit returns the number of records to fetch
 func (f Filters) limit() int {
+	if f.overFetch() {
+		return f.PageSize + 1
+	}
 	return f.PageSize
 }
 
@@ -74,3 +223,85 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// buildPage turns the rows read for a page into the page and its metadata.
+// It drops the extra row read by limit() and restores the listing order of
+// a backward read. sortValue returns the value of a sort key for a row,
+// formatted so that the database can read it back as the key's type.
+func buildPage[T any](items []T, f Filters, totalRecords int, sortValue func(item T, key string) string) ([]T, Metadata) {
+	more := false
+	if f.overFetch() {
+		more = len(items) > f.PageSize
+		if more {
+			items = items[:f.PageSize]
+		}
+	} else {
+		more = f.offset()+len(items) < totalRecords
+	}
+
+	var metadata Metadata
+	var hasNext, hasPrev bool
+	switch {
+	case f.Cursor.IsZero():
+		metadata = calculateMetaData(totalRecords, f.Page, f.PageSize, f.Count)
+		hasNext, hasPrev = more, f.Page > 1
+	case f.Cursor.Backward:
+		metadata = calculateMetaData(totalRecords, 0, f.PageSize, f.Count)
+		slices.Reverse(items)
+		hasNext, hasPrev = true, more
+	default:
+		metadata = calculateMetaData(totalRecords, 0, f.PageSize, f.Count)
+		hasNext, hasPrev = more, true
+	}
+	metadata.HasMore = hasNext
+
+	keys := f.sortKeys()
+	if len(items) > 0 {
+		if hasNext {
+			metadata.next = Cursor{Sort: f.Sort, Values: sortValues(keys, items[len(items)-1], sortValue)}
+		}
+		if hasPrev {
+			metadata.prev = Cursor{Sort: f.Sort, Values: sortValues(keys, items[0], sortValue), Backward: true}
+		}
+	}
+	return items, metadata
+}
+
+// sortValues returns the values of keys for item.
+func sortValues[T any](keys []sortKey, item T, sortValue func(item T, key string) string) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = sortValue(item, key.name)
+	}
+	return values
+}
+
+// countRows returns the number of rows of from matching where, counted
+// exactly or, with CountEstimated, taken from the planner's estimate, which
+// costs no more than planning the query.
+func countRows(ctx context.Context, db DBTX, from, where string, args []any, count string) (int, error) {
+	if count == CountEstimated {
+		var plan []byte
+		err := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) SELECT 1 FROM "+from+" WHERE "+where, args...).Scan(&plan)
+		if err != nil {
+			return 0, err
+		}
+		var explained []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			} `json:"Plan"`
+		}
+		err = json.Unmarshal(plan, &explained)
+		if err != nil {
+			return 0, err
+		}
+		if len(explained) == 0 {
+			return 0, errors.New("empty query plan")
+		}
+		return int(explained[0].Plan.Rows), nil
+	}
+
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+from+" WHERE "+where, args...).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,278 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/martinezmoises/Test1/internal/validator"
+)
+
+var (
+	// ErrIdempotencyKeyInUse is returned when a request with the same key is
+	// still being processed.
+	ErrIdempotencyKeyInUse = errors.New("idempotency key in use")
+	// ErrIdempotencyKeyMismatch is returned when a key is reused for a
+	// different request.
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+	// ErrIdempotencyResponseLost is returned when the request with the same
+	// key succeeded but its response could not be stored.
+	ErrIdempotencyResponseLost = errors.New("idempotent request succeeded without a stored response")
+	// ErrIdempotencyClaimLost is returned when a request's lease on its key
+	// ran out and another request took the key over.
+	ErrIdempotencyClaimLost = errors.New("idempotency key claimed by another request")
+)
+
+// IdempotencyLease bounds how long a claimed key stays locked without a
+// stored response, so that a request lost in a crash does not lock its key
+// until it expires. Requests renew their lease while they run.
+const IdempotencyLease = time.Minute
+
+// IdempotencyKey identifies a request by the Idempotency-Key header value
+// its client sent. Keys belong to a user, so that clients cannot replay each
+// other's responses.
+type IdempotencyKey struct {
+	UserID int64
+	Key    string
+}
+
+// IdempotencyClaim is held by the request that claimed a key. Its token
+// tells that request apart from one that took the key over later.
+type IdempotencyClaim struct {
+	Key   IdempotencyKey
+	Token []byte
+}
+
+// newIdempotencyClaim creates a claim on key with a random token.
+func newIdempotencyClaim(key IdempotencyKey) (*IdempotencyClaim, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	return &IdempotencyClaim{Key: key, Token: token}, nil
+}
+
+// IdempotentRequest is what a key is claimed for: the endpoint and a
+// fingerprint of the body.
+type IdempotentRequest struct {
+	Endpoint    string // method and path, such as "POST /v1/products"
+	Fingerprint []byte // SHA-256 of the body
+}
+
+// IdempotentResponse is a stored response, replayed for retries.
+type IdempotentResponse struct {
+	Status  int
+	Headers http.Header
+	Body    []byte
+}
+
+// ValidateIdempotencyKey checks an Idempotency-Key header value.
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(len(key) <= 255, "Idempotency-Key", "must not be more than 255 bytes long")
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			v.AddError("Idempotency-Key", "must only contain visible ASCII characters")
+			break
+		}
+	}
+}
+
+// IdempotencyStore is the set of operations the idempotency middleware
+// needs from a storage backend. IdempotencyModel (PostgreSQL) and
+// MemoryIdempotencyModel both satisfy it.
+type IdempotencyStore interface {
+	// Begin claims key for request until ttl passes. It returns the claim
+	// when the key was claimed, the stored response when the same request
+	// was already answered, ErrIdempotencyKeyInUse while it is being
+	// answered, ErrIdempotencyResponseLost when it succeeded without a
+	// stored response and ErrIdempotencyKeyMismatch when the key was used
+	// for another request.
+	Begin(ctx context.Context, key IdempotencyKey, request IdempotentRequest, ttl time.Duration) (*IdempotencyClaim, *IdempotentResponse, error)
+	// Renew extends the lease of a claim.
+	Renew(ctx context.Context, claim *IdempotencyClaim) error
+	// Succeed marks the request of a claim as succeeded, so that the key is
+	// never taken over even if no response is stored.
+	Succeed(ctx context.Context, claim *IdempotencyClaim) error
+	// Complete stores the response for a claim.
+	Complete(ctx context.Context, claim *IdempotencyClaim, response *IdempotentResponse) error
+	// Release gives up a claim, so that the request can be retried.
+	Release(ctx context.Context, claim *IdempotencyClaim) error
+	// DeleteExpired removes expired keys and returns how many there were.
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// IdempotencyModel struct wraps the DB connection pool.
+type IdempotencyModel struct {
+	DB       *sql.DB
+	Timeouts QueryTimeouts
+}
+
+// Begin claims a key, taking over keys that have expired or whose lease
+// has run out before their request succeeded.
+func (m IdempotencyModel) Begin(ctx context.Context, key IdempotencyKey, request IdempotentRequest, ttl time.Duration) (*IdempotencyClaim, *IdempotentResponse, error) {
+	claim, err := newIdempotencyClaim(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	insert := `
+		INSERT INTO idempotency_keys (user_id, key, endpoint, fingerprint, claim, locked_until, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + $6::float8 * INTERVAL '1 millisecond', NOW() + $7::float8 * INTERVAL '1 millisecond')
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET endpoint = EXCLUDED.endpoint, fingerprint = EXCLUDED.fingerprint, claim = EXCLUDED.claim,
+			locked_until = EXCLUDED.locked_until, expires_at = EXCLUDED.expires_at, status = NULL, headers = NULL,
+			body = NULL, succeeded = false, created_at = NOW()
+		WHERE idempotency_keys.expires_at <= NOW()
+		OR (idempotency_keys.status IS NULL AND NOT idempotency_keys.succeeded AND idempotency_keys.locked_until <= NOW())
+	`
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, insert, key.UserID, key.Key, request.Endpoint, request.Fingerprint, claim.Token,
+		IdempotencyLease.Milliseconds(), ttl.Milliseconds())
+	if err != nil {
+		return nil, nil, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+	if claimed == 1 {
+		return claim, nil, nil
+	}
+
+	// Someone else holds the key
+	query := `
+		SELECT endpoint, fingerprint, succeeded, status, headers, body
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
+	`
+	var stored IdempotentRequest
+	var succeeded bool
+	var status sql.NullInt32
+	var headers []byte
+	var body []byte
+	err = m.DB.QueryRowContext(ctx, query, key.UserID, key.Key).Scan(&stored.Endpoint, &stored.Fingerprint, &succeeded, &status, &headers, &body)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted by DeleteExpired in between; the client may retry
+			return nil, nil, ErrIdempotencyKeyInUse
+		}
+		return nil, nil, err
+	}
+	response, err := storedResponse(stored, request, succeeded, status, headers, body)
+	return nil, response, err
+}
+
+// storedResponse decides what a request that found its key taken gets.
+func storedResponse(stored, request IdempotentRequest, succeeded bool, status sql.NullInt32, headers, body []byte) (*IdempotentResponse, error) {
+	if stored.Endpoint != request.Endpoint || !bytes.Equal(stored.Fingerprint, request.Fingerprint) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+	if !status.Valid {
+		if succeeded {
+			return nil, ErrIdempotencyResponseLost
+		}
+		return nil, ErrIdempotencyKeyInUse
+	}
+
+	response := &IdempotentResponse{Status: int(status.Int32), Body: body}
+	err := json.Unmarshal(headers, &response.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Renew extends the lease of a claim that has no stored response.
+func (m IdempotencyModel) Renew(ctx context.Context, claim *IdempotencyClaim) error {
+	query := `
+		UPDATE idempotency_keys
+		SET locked_until = NOW() + $4::float8 * INTERVAL '1 millisecond'
+		WHERE user_id = $1 AND key = $2 AND claim = $3 AND status IS NULL
+	`
+	return m.updateClaim(ctx, claim, query, IdempotencyLease.Milliseconds())
+}
+
+// Succeed marks the request of a claim as succeeded.
+func (m IdempotencyModel) Succeed(ctx context.Context, claim *IdempotencyClaim) error {
+	query := `
+		UPDATE idempotency_keys
+		SET succeeded = true
+		WHERE user_id = $1 AND key = $2 AND claim = $3 AND status IS NULL
+	`
+	return m.updateClaim(ctx, claim, query)
+}
+
+// Complete stores the response for a claim.
+func (m IdempotencyModel) Complete(ctx context.Context, claim *IdempotencyClaim, response *IdempotentResponse) error {
+	headers, err := json.Marshal(response.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $4, headers = $5, body = $6
+		WHERE user_id = $1 AND key = $2 AND claim = $3 AND status IS NULL
+	`
+	return m.updateClaim(ctx, claim, query, response.Status, string(headers), response.Body)
+}
+
+// Release deletes a claimed key whose request has neither succeeded nor
+// stored a response.
+func (m IdempotencyModel) Release(ctx context.Context, claim *IdempotencyClaim) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND claim = $3 AND status IS NULL AND NOT succeeded
+	`
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, claim.Key.UserID, claim.Key.Key, claim.Token)
+	return err
+}
+
+// updateClaim runs a statement on the key of a claim, whose first three
+// arguments are the user ID, key and claim token. It returns
+// ErrIdempotencyClaimLost when the statement matched no row.
+func (m IdempotencyModel) updateClaim(ctx context.Context, claim *IdempotencyClaim, query string, args ...any) error {
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	args = append([]any{claim.Key.UserID, claim.Key.Key, claim.Token}, args...)
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrIdempotencyClaimLost
+	}
+	return nil
+}
+
+// DeleteExpired removes expired keys.
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at <= NOW()
+	`
+	ctx, cancel := m.Timeouts.maintenance(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
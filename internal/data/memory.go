@@ -0,0 +1,892 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MemoryStore holds products and reviews in process memory. It is meant for
+// local development and tests where no PostgreSQL server is available.
+// Operations are not interruptible, so its models only check that their
+// context is still live before starting.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	txMu          sync.Mutex // held by the running transaction and by writes outside one, see lock
+	products      map[int64]*Product
+	reviews       map[int64]*Review
+	revisions     map[int64][]*ProductRevision // by product ID, in version order
+	audit         []*AuditEvent                // in ID order
+	users         map[int64]*User
+	tokens        map[string]*Token
+	permissions   map[int64]Permissions
+	idempotency   map[IdempotencyKey]*idempotencyEntry
+	nextProductID int64
+	nextReviewID  int64
+	nextUserID    int64
+	nextAuditID   int64
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		products:    make(map[int64]*Product),
+		reviews:     make(map[int64]*Review),
+		revisions:   make(map[int64][]*ProductRevision),
+		users:       make(map[int64]*User),
+		tokens:      make(map[string]*Token),
+		permissions: make(map[int64]Permissions),
+		idempotency: make(map[IdempotencyKey]*idempotencyEntry),
+	}
+}
+
+// memorySnapshot is the state of a MemoryStore, idempotency keys aside.
+type memorySnapshot struct {
+	products      map[int64]*Product
+	reviews       map[int64]*Review
+	revisions     map[int64][]*ProductRevision
+	audit         []*AuditEvent
+	users         map[int64]*User
+	tokens        map[string]*Token
+	permissions   map[int64]Permissions
+	nextProductID int64
+	nextReviewID  int64
+	nextUserID    int64
+	nextAuditID   int64
+}
+
+// snapshot copies the state of the store, idempotency keys aside. Stored
+// records are replaced rather than modified, and revisions, audit events
+// and permissions only appended, so the maps are copied but not the
+// records, and the slices are kept up to their current length.
+func (s *MemoryStore) snapshot() memorySnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return memorySnapshot{
+		products:      maps.Clone(s.products),
+		reviews:       maps.Clone(s.reviews),
+		revisions:     maps.Clone(s.revisions),
+		audit:         s.audit,
+		users:         maps.Clone(s.users),
+		tokens:        maps.Clone(s.tokens),
+		permissions:   maps.Clone(s.permissions),
+		nextProductID: s.nextProductID,
+		nextReviewID:  s.nextReviewID,
+		nextUserID:    s.nextUserID,
+		nextAuditID:   s.nextAuditID,
+	}
+}
+
+// restore puts back the state of a snapshot.
+func (s *MemoryStore) restore(snapshot memorySnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.products = snapshot.products
+	s.reviews = snapshot.reviews
+	s.revisions = snapshot.revisions
+	s.audit = snapshot.audit
+	s.users = snapshot.users
+	s.tokens = snapshot.tokens
+	s.permissions = snapshot.permissions
+	s.nextProductID = snapshot.nextProductID
+	s.nextReviewID = snapshot.nextReviewID
+	s.nextUserID = snapshot.nextUserID
+	s.nextAuditID = snapshot.nextAuditID
+}
+
+// lock takes s.mu for writing and returns the function releasing it.
+// Writes made outside a transaction (inTx false) first wait for the running
+// transaction, if any, to finish, so that rolling it back by restoring its
+// snapshot cannot undo them.
+func (s *MemoryStore) lock(inTx bool) (unlock func()) {
+	if !inTx {
+		s.txMu.Lock()
+	}
+	s.mu.Lock()
+	return func() {
+		s.mu.Unlock()
+		if !inTx {
+			s.txMu.Unlock()
+		}
+	}
+}
+
+// MemoryProductModel is a ProductStore backed by a MemoryStore.
+type MemoryProductModel struct {
+	Store *MemoryStore
+	inTx  bool // set on the models of a transaction, see NewMemoryModels
+}
+
+// MemoryReviewModel is a ReviewStore backed by a MemoryStore.
+type MemoryReviewModel struct {
+	Store *MemoryStore
+	inTx  bool
+}
+
+// Insert adds a new product and sets its ID, creation time and version,
+// and records its first revision and an audit event.
+func (p MemoryProductModel) Insert(ctx context.Context, product *Product) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := p.Store
+	defer s.lock(p.inTx)()
+
+	s.nextProductID++
+	product.ID = s.nextProductID
+	product.AverageRating = 0
+	product.ReviewCount = 0
+	product.CreatedAt = time.Now().Truncate(time.Second)
+	product.UpdatedAt = product.CreatedAt
+	product.Version = 1
+
+	stored := *product
+	s.products[product.ID] = &stored
+	s.addRevision(ctx, &stored, snapshotOf(&stored).values())
+	s.addAuditEvent(ctx, AuditResourceProduct, product.ID, AuditActionCreate, nil, &stored)
+	return nil
+}
+
+// Get retrieves a specific product by ID.
+func (p MemoryProductModel) Get(ctx context.Context, id int64) (*Product, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	s := p.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.products[id]
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrRecordNotFound
+	}
+	product := *stored
+	return &product, nil
+}
+
+// Update replaces the stored product and bumps its version, provided the
+// stored version still matches product.Version, and records a revision
+// holding the changed fields and an audit event.
+func (p MemoryProductModel) Update(ctx context.Context, product *Product) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := p.Store
+	defer s.lock(p.inTx)()
+
+	stored, ok := s.products[product.ID]
+	if !ok || stored.DeletedAt != nil || stored.Version != product.Version {
+		return ErrEditConflict
+	}
+	product.CreatedAt = stored.CreatedAt
+	product.AverageRating = stored.AverageRating
+	product.ReviewCount = stored.ReviewCount
+	product.UpdatedAt = time.Now().Truncate(time.Second)
+	product.Version = stored.Version + 1
+
+	updated := *product
+	s.products[product.ID] = &updated
+	s.addRevision(ctx, &updated, revisionChanges(snapshotOf(stored), snapshotOf(&updated)))
+	s.addAuditEvent(ctx, AuditResourceProduct, product.ID, AuditActionUpdate, stored, &updated)
+	return nil
+}
+
+// addRevision records a revision of product made by the actor of ctx,
+// like insertRevision. The caller must hold s.mu for writing.
+func (s *MemoryStore) addRevision(ctx context.Context, product *Product, changes map[string]any) {
+	revision := &ProductRevision{
+		ProductID: product.ID,
+		Version:   product.Version,
+		Changes:   changes,
+		ActorID:   ActorFromContext(ctx).UserID,
+		CreatedAt: product.UpdatedAt,
+	}
+	s.revisions[product.ID] = append(s.revisions[product.ID], revision)
+}
+
+// addAuditEvent records a write made by the actor of ctx, like
+// insertAuditEvent. The caller must hold s.mu for writing.
+func (s *MemoryStore) addAuditEvent(ctx context.Context, resource string, resourceID int64, action string, before, after any) {
+	// Products and reviews always encode
+	encodedBefore, _ := auditJSON(before)
+	encodedAfter, _ := auditJSON(after)
+
+	actor := ActorFromContext(ctx)
+	s.nextAuditID++
+	s.audit = append(s.audit, &AuditEvent{
+		ID:         s.nextAuditID,
+		CreatedAt:  time.Now().Truncate(time.Second),
+		ActorID:    actor.UserID,
+		ClientIP:   actor.ClientIP,
+		RequestID:  actor.RequestID,
+		Resource:   resource,
+		ResourceID: resourceID,
+		Action:     action,
+		Before:     encodedBefore,
+		After:      encodedAfter,
+	})
+}
+
+// Delete moves a product at the given version to the trash, along with its
+// reviews, and records an audit event, like ProductModel.Delete.
+func (p MemoryProductModel) Delete(ctx context.Context, id int64, version int32) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	s := p.Store
+	defer s.lock(p.inTx)()
+
+	stored, ok := s.products[id]
+	if !ok || stored.DeletedAt != nil || stored.Version != version {
+		return ErrEditConflict
+	}
+	now := time.Now().Truncate(time.Second)
+	deleted := *stored
+	deleted.DeletedAt = &now
+	deleted.Version++
+	deleted.UpdatedAt = now
+	s.products[id] = &deleted
+
+	for reviewID, review := range s.reviews {
+		if review.ProductID == id && review.DeletedAt == nil {
+			deletedReview := *review
+			deletedReview.DeletedAt = &now
+			deletedReview.deletedWithProduct = true
+			deletedReview.Version++
+			deletedReview.UpdatedAt = now
+			s.reviews[reviewID] = &deletedReview
+		}
+	}
+	s.addAuditEvent(ctx, AuditResourceProduct, id, AuditActionDelete, stored, nil)
+	return nil
+}
+
+// Restore takes a product out of the trash, together with the reviews that
+// were deleted with it, like ProductModel.Restore.
+func (p MemoryProductModel) Restore(ctx context.Context, id int64) (*Product, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := p.Store
+	defer s.lock(p.inTx)()
+
+	stored, ok := s.products[id]
+	if !ok || stored.DeletedAt == nil {
+		return nil, ErrRecordNotFound
+	}
+	restored := *stored
+	restored.DeletedAt = nil
+	restored.Version++
+	restored.UpdatedAt = time.Now().Truncate(time.Second)
+	s.products[id] = &restored
+
+	for reviewID, review := range s.reviews {
+		if review.ProductID == id && review.deletedWithProduct {
+			restoredReview := *review
+			restoredReview.DeletedAt = nil
+			restoredReview.deletedWithProduct = false
+			restoredReview.Version++
+			restoredReview.UpdatedAt = restored.UpdatedAt
+			s.reviews[reviewID] = &restoredReview
+		}
+	}
+	s.addAuditEvent(ctx, AuditResourceProduct, id, AuditActionRestore, stored, &restored)
+
+	product := restored
+	return &product, nil
+}
+
+// GetDeleted retrieves the products in the trash, with sorting and
+// pagination.
+func (p MemoryProductModel) GetDeleted(ctx context.Context, filters Filters) ([]*Product, Metadata, error) {
+	if ctx.Err() != nil {
+		return nil, Metadata{}, ctx.Err()
+	}
+
+	s := p.Store
+	s.mu.RLock()
+	matched := []*Product{}
+	for _, stored := range s.products {
+		if stored.DeletedAt != nil {
+			product := *stored
+			matched = append(matched, &product)
+		}
+	}
+	s.mu.RUnlock()
+
+	order := listingOrder(filters, compareProductKey)
+	keys := filters.sortKeys()
+	slices.SortFunc(matched, func(a, b *Product) int {
+		return order(a, sortValues(keys, b, productSortValue))
+	})
+
+	page := paginate(matched, filters, order)
+	products, metadata := buildPage(page, filters, len(matched), productSortValue)
+	return products, metadata, nil
+}
+
+// GetAll retrieves all products, with filtering, sorting, and pagination.
+// Like ProductModel.GetAll, a search that matches nothing falls back to
+// similar spellings of the query.
+func (p MemoryProductModel) GetAll(ctx context.Context, filter ProductFilter, filters Filters) ([]*Product, Metadata, error) {
+	if ctx.Err() != nil {
+		return nil, Metadata{}, ctx.Err()
+	}
+
+	filter, matched := p.search(filter)
+
+	order := listingOrder(filters, compareProductKey)
+	keys := filters.sortKeys()
+	slices.SortFunc(matched, func(a, b *Product) int {
+		return order(a, sortValues(keys, b, productSortValue))
+	})
+
+	page := paginate(matched, filters, order)
+	products, metadata := buildPage(page, filters, len(matched), productSortValue)
+	metadata.Fuzzy = filter.fuzzy
+	return products, metadata, nil
+}
+
+// search returns copies of the products passing filter, ranked when it
+// has a search query. Unless filter is already fuzzy, a search that matches
+// nothing is retried as a fuzzy one; the filter finally used is returned.
+func (p MemoryProductModel) search(filter ProductFilter) (ProductFilter, []*Product) {
+	query := parseWebSearch(filter.Query)
+
+	s := p.Store
+	s.mu.RLock()
+	candidates := []*Product{}
+	for _, stored := range s.products {
+		if productMatches(filter, stored) {
+			candidates = append(candidates, stored)
+		}
+	}
+	s.mu.RUnlock()
+
+	matched := []*Product{}
+	if !filter.fuzzy {
+		for _, stored := range candidates {
+			product := *stored
+			if filter.Query != "" {
+				name, description := splitWords(product.Name), splitWords(product.Description)
+				if !query.matches(append(name, description...)) {
+					continue
+				}
+				product.Rank = query.rank(name, description)
+				product.Headline = query.headline(product.Name + ". " + product.Description)
+			}
+			matched = append(matched, &product)
+		}
+		if filter.Query == "" || len(matched) > 0 {
+			return filter, matched
+		}
+		filter.fuzzy = true
+	}
+
+	for _, stored := range candidates {
+		product := *stored
+		product.Rank = max(wordSimilarity(filter.Query, product.Name), wordSimilarity(filter.Query, product.Category))
+		if product.Rank >= fuzzySimilarity {
+			matched = append(matched, &product)
+		}
+	}
+	return filter, matched
+}
+
+// Facets counts the products passing filter by each of the named facets,
+// like ProductModel.Facets.
+func (p MemoryProductModel) Facets(ctx context.Context, filter ProductFilter, names []string) (Facets, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	filter, _ = p.search(filter)
+
+	facets := make(Facets)
+	for _, name := range names {
+		if _, done := facets[name]; done {
+			continue
+		}
+		_, products := p.search(facetFilter(filter, name))
+
+		switch name {
+		case FacetCategory:
+			counts := make(map[string]int)
+			for _, product := range products {
+				counts[product.Category]++
+			}
+			facet := []FacetCount{}
+			for category, count := range counts {
+				facet = append(facet, FacetCount{Value: category, Count: count})
+			}
+			slices.SortFunc(facet, func(a, b FacetCount) int {
+				return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Value, b.Value))
+			})
+			facets[name] = facet[:min(len(facet), maxCategoryFacets)]
+
+		case FacetPrice:
+			counts := make([]int, len(PriceFacetBounds)+1)
+			for _, product := range products {
+				// Like width_bucket: the number of bounds at or below the price
+				bucket, found := slices.BinarySearch(PriceFacetBounds, product.Price)
+				if found {
+					bucket++
+				}
+				counts[bucket]++
+			}
+			facets[name] = priceFacetCounts(counts)
+
+		case FacetRating:
+			counts := make([]int, len(RatingFacetThresholds))
+			for _, product := range products {
+				for i, threshold := range RatingFacetThresholds {
+					if product.AverageRating >= float64(threshold) {
+						counts[i]++
+					}
+				}
+			}
+			facets[name] = ratingFacetCounts(counts)
+		}
+	}
+	return facets, nil
+}
+
+// Suggest returns up to limit products whose name, or a word of it, starts
+// with prefix, like ProductModel.Suggest.
+func (p MemoryProductModel) Suggest(ctx context.Context, prefix string, limit int) ([]*ProductSuggestion, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+
+	type match struct {
+		product *Product
+		leading bool // the name itself starts with prefix
+	}
+	var matches []match
+
+	s := p.Store
+	s.mu.RLock()
+	for _, product := range s.products {
+		if product.DeletedAt != nil {
+			continue
+		}
+		name := strings.ToLower(product.Name)
+		if strings.HasPrefix(name, prefix) || strings.Contains(name, " "+prefix) {
+			matches = append(matches, match{product: product, leading: strings.HasPrefix(name, prefix)})
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(matches, func(a, b match) int {
+		if a.leading != b.leading {
+			if a.leading {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(
+			cmp.Compare(b.product.ReviewCount, a.product.ReviewCount),
+			strings.Compare(a.product.Name, b.product.Name),
+			cmp.Compare(a.product.ID, b.product.ID),
+		)
+	})
+
+	suggestions := []*ProductSuggestion{}
+	for _, m := range matches[:min(limit, len(matches))] {
+		suggestions = append(suggestions, &ProductSuggestion{ID: m.product.ID, Name: m.product.Name, Category: m.product.Category})
+	}
+	return suggestions, nil
+}
+
+// Insert adds a new review and records an audit event. The parent product
+// must exist.
+func (m MemoryReviewModel) Insert(ctx context.Context, review *Review) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	if product, ok := s.products[review.ProductID]; !ok || product.DeletedAt != nil {
+		return ErrRecordNotFound
+	}
+
+	s.nextReviewID++
+	review.ID = s.nextReviewID
+	review.CreatedAt = time.Now().Truncate(time.Second)
+	review.UpdatedAt = review.CreatedAt
+	review.Version = 1
+
+	stored := *review
+	s.reviews[review.ID] = &stored
+	s.refreshProductRating(review.ProductID)
+	s.addAuditEvent(ctx, AuditResourceReview, review.ID, AuditActionCreate, nil, &stored)
+	return nil
+}
+
+// Get retrieves a specific review by its ID and associated product ID.
+func (m MemoryReviewModel) Get(ctx context.Context, productID, reviewID int64) (*Review, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.reviews[reviewID]
+	if !ok || stored.DeletedAt != nil || stored.ProductID != productID {
+		return nil, ErrRecordNotFound
+	}
+	review := *stored
+	return &review, nil
+}
+
+// Update replaces the stored review and bumps its version, provided the
+// stored version still matches review.Version, and records an audit event.
+func (m MemoryReviewModel) Update(ctx context.Context, review *Review) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	stored, ok := s.reviews[review.ID]
+	if !ok || stored.DeletedAt != nil || stored.ProductID != review.ProductID || stored.Version != review.Version {
+		return ErrEditConflict
+	}
+	review.CreatedAt = stored.CreatedAt
+	review.UpdatedAt = time.Now().Truncate(time.Second)
+	review.Version = stored.Version + 1
+
+	updated := *review
+	s.reviews[review.ID] = &updated
+	s.refreshProductRating(review.ProductID)
+	s.addAuditEvent(ctx, AuditResourceReview, review.ID, AuditActionUpdate, stored, &updated)
+	return nil
+}
+
+// Delete moves a review to the trash by its ID and associated product ID,
+// provided it is still at the given version, bumps its version and records
+// an audit event, like ReviewModel.Delete.
+func (m MemoryReviewModel) Delete(ctx context.Context, productID, reviewID int64, version int32) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	stored, ok := s.reviews[reviewID]
+	if !ok || stored.DeletedAt != nil || stored.ProductID != productID || stored.Version != version {
+		return ErrEditConflict
+	}
+	now := time.Now().Truncate(time.Second)
+	deleted := *stored
+	deleted.DeletedAt = &now
+	deleted.Version++
+	deleted.UpdatedAt = now
+	s.reviews[reviewID] = &deleted
+	s.refreshProductRating(productID)
+	s.addAuditEvent(ctx, AuditResourceReview, reviewID, AuditActionDelete, stored, nil)
+	return nil
+}
+
+// Reassign moves every review of a product to another one, like
+// ReviewModel.Reassign.
+func (m MemoryReviewModel) Reassign(ctx context.Context, fromProductID, toProductID int64) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	from, fromExists := s.products[fromProductID]
+	to, toExists := s.products[toProductID]
+	if !fromExists || !toExists || from.DeletedAt != nil || to.DeletedAt != nil {
+		return 0, ErrRecordNotFound
+	}
+
+	// In ID order, so that the audit events come out as with PostgreSQL
+	var ids []int64
+	for id, stored := range s.reviews {
+		if stored.ProductID == fromProductID && stored.DeletedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		stored := s.reviews[id]
+		review := *stored
+		review.ProductID = toProductID
+		review.Version++
+		review.UpdatedAt = time.Now().Truncate(time.Second)
+		s.reviews[id] = &review
+		s.addAuditEvent(ctx, AuditResourceReview, id, AuditActionUpdate, stored, &review)
+	}
+	moved := len(ids)
+	s.refreshProductRating(fromProductID)
+	s.refreshProductRating(toProductID)
+	return moved, nil
+}
+
+// refreshProductRating recomputes a product's average rating and review
+// count, mirroring refreshProductRating for PostgreSQL: the version is left
+// alone. The caller must hold s.mu for writing.
+func (s *MemoryStore) refreshProductRating(productID int64) {
+	product, ok := s.products[productID]
+	if !ok {
+		return
+	}
+
+	total, count := 0, 0
+	for _, review := range s.reviews {
+		if review.ProductID == productID && review.DeletedAt == nil {
+			total += review.Rating
+			count++
+		}
+	}
+
+	updated := *product
+	updated.AverageRating = 0
+	if count > 0 {
+		updated.AverageRating = math.Round(float64(total)/float64(count)*100) / 100
+	}
+	updated.ReviewCount = count
+	updated.UpdatedAt = time.Now().Truncate(time.Second)
+	s.products[productID] = &updated
+}
+
+// GetAll retrieves reviews for a product (or every review when productID is
+// 0) with sorting and pagination.
+func (m MemoryReviewModel) GetAll(ctx context.Context, productID int64, filters Filters) ([]*Review, Metadata, error) {
+	if ctx.Err() != nil {
+		return nil, Metadata{}, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	matched := []*Review{}
+	for _, stored := range s.reviews {
+		if stored.DeletedAt != nil || productID != 0 && stored.ProductID != productID {
+			continue
+		}
+		review := *stored
+		matched = append(matched, &review)
+	}
+	s.mu.RUnlock()
+
+	order := listingOrder(filters, compareReviewKey)
+	keys := filters.sortKeys()
+	slices.SortFunc(matched, func(a, b *Review) int {
+		return order(a, sortValues(keys, b, reviewSortValue))
+	})
+
+	page := paginate(matched, filters, order)
+	reviews, metadata := buildPage(page, filters, len(matched), reviewSortValue)
+	return reviews, metadata, nil
+}
+
+// GetTopForProducts returns up to limit reviews of each of the products,
+// like ReviewModel.GetTopForProducts.
+func (m MemoryReviewModel) GetTopForProducts(ctx context.Context, productIDs []int64, limit int) (map[int64][]*Review, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	reviews := make(map[int64][]*Review, len(productIDs))
+	for _, stored := range s.reviews {
+		if stored.DeletedAt == nil && slices.Contains(productIDs, stored.ProductID) {
+			review := *stored
+			reviews[review.ProductID] = append(reviews[review.ProductID], &review)
+		}
+	}
+	s.mu.RUnlock()
+
+	for productID, productReviews := range reviews {
+		slices.SortFunc(productReviews, func(a, b *Review) int {
+			return cmp.Or(
+				cmp.Compare(b.HelpfulCount, a.HelpfulCount),
+				b.CreatedAt.Compare(a.CreatedAt),
+				cmp.Compare(b.ID, a.ID),
+			)
+		})
+		reviews[productID] = productReviews[:min(limit, len(productReviews))]
+	}
+	return reviews, nil
+}
+
+// productMatches reports whether product passes filter, like the condition
+// built by ProductFilter.where.
+func productMatches(filter ProductFilter, product *Product) bool {
+	switch {
+	case product.DeletedAt != nil:
+		return false
+	case filter.Name != "" && !matchesText(product.Name, filter.Name):
+		return false
+	case len(filter.Categories) > 0 && !slices.Contains(filter.Categories, product.Category):
+		return false
+	case filter.MinPrice > 0 && product.Price < filter.MinPrice:
+		return false
+	case filter.MaxPrice > 0 && product.Price > filter.MaxPrice:
+		return false
+	case filter.MinRating > 0 && product.AverageRating < filter.MinRating:
+		return false
+	case !filter.CreatedAfter.IsZero() && !product.CreatedAt.After(filter.CreatedAfter):
+		return false
+	case !filter.CreatedBefore.IsZero() && !product.CreatedAt.Before(filter.CreatedBefore):
+		return false
+	case filter.HasReviews != nil && *filter.HasReviews != (product.ReviewCount > 0):
+		return false
+	}
+	return true
+}
+
+// listingOrder returns a function placing an item relative to a position
+// (sort key values as in a Cursor) in the listing order of filters.
+// compareKey compares one sort key of an item with a value formatted like
+// the ones in cursors.
+func listingOrder[T any](filters Filters, compareKey func(item T, key, value string) int) func(item T, position []string) int {
+	keys := filters.sortKeys()
+	return func(item T, position []string) int {
+		for i, key := range keys {
+			c := compareKey(item, key.name, position[i])
+			if key.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+// compareProductKey compares a sort key of product with value.
+func compareProductKey(product *Product, key, value string) int {
+	switch key {
+	case "name":
+		return strings.Compare(product.Name, value)
+	case "price":
+		price, _ := strconv.ParseFloat(value, 64)
+		return cmp.Compare(product.Price, price)
+	case "average_rating":
+		rating, _ := strconv.ParseFloat(value, 64)
+		return cmp.Compare(product.AverageRating, rating)
+	case "review_count":
+		count, _ := strconv.Atoi(value)
+		return cmp.Compare(product.ReviewCount, count)
+	case "created_at":
+		createdAt, _ := time.Parse(time.RFC3339Nano, value)
+		return product.CreatedAt.Compare(createdAt)
+	case "deleted_at":
+		deletedAt, _ := time.Parse(time.RFC3339Nano, value)
+		return product.DeletedAt.Compare(deletedAt)
+	case "relevance":
+		rank, _ := strconv.ParseFloat(value, 64)
+		return cmp.Compare(-product.Rank, rank)
+	default:
+		id, _ := strconv.ParseInt(value, 10, 64)
+		return cmp.Compare(product.ID, id)
+	}
+}
+
+// compareReviewKey compares a sort key of review with value.
+func compareReviewKey(review *Review, key, value string) int {
+	switch key {
+	case "rating":
+		rating, _ := strconv.Atoi(value)
+		return cmp.Compare(review.Rating, rating)
+	case "helpful_count":
+		count, _ := strconv.Atoi(value)
+		return cmp.Compare(review.HelpfulCount, count)
+	case "created_at":
+		createdAt, _ := time.Parse(time.RFC3339Nano, value)
+		return review.CreatedAt.Compare(createdAt)
+	default:
+		id, _ := strconv.ParseInt(value, 10, 64)
+		return cmp.Compare(review.ID, id)
+	}
+}
+
+// paginate returns the rows a query with filters would read from items,
+// which are sorted in listing order: a LIMIT/OFFSET slice in page mode, or
+// the rows past the cursor (placed by order) in cursor mode. Like the SQL
+// query, a backward read returns its rows in reverse.
+func paginate[T any](items []T, filters Filters, order func(item T, position []string) int) []T {
+	if filters.Cursor.IsZero() {
+		start := filters.offset()
+		if start >= len(items) {
+			return items[:0]
+		}
+		end := start + filters.limit()
+		if end > len(items) {
+			end = len(items)
+		}
+		return items[start:end]
+	}
+
+	// Index of the first row after the cursor position
+	i, found := slices.BinarySearchFunc(items, filters.Cursor.Values, order)
+	if !filters.Cursor.Backward {
+		if found {
+			i++
+		}
+		return items[i:min(i+filters.limit(), len(items))]
+	}
+
+	page := slices.Clone(items[max(0, i-filters.limit()):i])
+	slices.Reverse(page)
+	return page
+}
+
+// matchesText mimics to_tsvector('simple', text) @@ plainto_tsquery('simple',
+// query): every word of the query must appear as a word in text, ignoring case.
+func matchesText(text, query string) bool {
+	words := make(map[string]bool)
+	for _, word := range splitWords(text) {
+		words[word] = true
+	}
+	for _, word := range splitWords(query) {
+		if !words[word] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
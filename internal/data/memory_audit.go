@@ -0,0 +1,70 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+)
+
+// MemoryAuditModel is an AuditStore backed by a MemoryStore.
+type MemoryAuditModel struct {
+	Store *MemoryStore
+}
+
+// GetAll lists the audit events that pass the filter with sorting and
+// pagination.
+func (m MemoryAuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	if ctx.Err() != nil {
+		return nil, Metadata{}, ctx.Err()
+	}
+
+	matched := m.matching(filter)
+
+	order := listingOrder(filters, compareAuditKey)
+	keys := filters.sortKeys()
+	slices.SortFunc(matched, func(a, b *AuditEvent) int {
+		return order(a, sortValues(keys, b, auditSortValue))
+	})
+
+	page := paginate(matched, filters, order)
+	events, metadata := buildPage(page, filters, len(matched), auditSortValue)
+	return events, metadata, nil
+}
+
+// Export calls fn with every audit event that passes the filter, oldest
+// first.
+func (m MemoryAuditModel) Export(ctx context.Context, filter AuditFilter, fn func(event *AuditEvent) error) error {
+	for _, event := range m.matching(filter) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := fn(event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matching returns copies of the events that pass the filter, in ID order.
+func (m MemoryAuditModel) matching(filter AuditFilter) []*AuditEvent {
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []*AuditEvent{}
+	for _, stored := range s.audit {
+		if filter.matches(stored) {
+			event := *stored
+			matched = append(matched, &event)
+		}
+	}
+	return matched
+}
+
+// compareAuditKey compares a sort key of event with value.
+func compareAuditKey(event *AuditEvent, key, value string) int {
+	id, _ := strconv.ParseInt(value, 10, 64)
+	return cmp.Compare(event.ID, id)
+}
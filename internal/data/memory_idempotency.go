@@ -0,0 +1,143 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// MemoryIdempotencyModel is an IdempotencyStore backed by a MemoryStore.
+type MemoryIdempotencyModel struct {
+	Store *MemoryStore
+}
+
+// idempotencyEntry is a claimed key. response is nil until the first
+// request has been answered.
+type idempotencyEntry struct {
+	request     IdempotentRequest
+	claim       []byte
+	succeeded   bool
+	response    *IdempotentResponse
+	lockedUntil time.Time
+	expiresAt   time.Time
+}
+
+// Begin claims a key, like IdempotencyModel.Begin.
+func (m MemoryIdempotencyModel) Begin(ctx context.Context, key IdempotencyKey, request IdempotentRequest, ttl time.Duration) (*IdempotencyClaim, *IdempotentResponse, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.idempotency[key]
+	if ok && now.Before(entry.expiresAt) && (entry.response != nil || entry.succeeded || now.Before(entry.lockedUntil)) {
+		switch {
+		case entry.request.Endpoint != request.Endpoint || !bytes.Equal(entry.request.Fingerprint, request.Fingerprint):
+			return nil, nil, ErrIdempotencyKeyMismatch
+		case entry.response == nil && entry.succeeded:
+			return nil, nil, ErrIdempotencyResponseLost
+		case entry.response == nil:
+			return nil, nil, ErrIdempotencyKeyInUse
+		}
+		response := *entry.response
+		response.Headers = entry.response.Headers.Clone()
+		return nil, &response, nil
+	}
+
+	claim, err := newIdempotencyClaim(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.idempotency[key] = &idempotencyEntry{
+		request:     request,
+		claim:       claim.Token,
+		lockedUntil: now.Add(IdempotencyLease),
+		expiresAt:   now.Add(ttl),
+	}
+	return claim, nil, nil
+}
+
+// Renew extends the lease of a claim that has no stored response.
+func (m MemoryIdempotencyModel) Renew(ctx context.Context, claim *IdempotencyClaim) error {
+	return m.updateClaim(ctx, claim, func(entry *idempotencyEntry) {
+		entry.lockedUntil = time.Now().Add(IdempotencyLease)
+	})
+}
+
+// Succeed marks the request of a claim as succeeded.
+func (m MemoryIdempotencyModel) Succeed(ctx context.Context, claim *IdempotencyClaim) error {
+	return m.updateClaim(ctx, claim, func(entry *idempotencyEntry) {
+		entry.succeeded = true
+	})
+}
+
+// Complete stores the response for a claim.
+func (m MemoryIdempotencyModel) Complete(ctx context.Context, claim *IdempotencyClaim, response *IdempotentResponse) error {
+	return m.updateClaim(ctx, claim, func(entry *idempotencyEntry) {
+		stored := *response
+		stored.Headers = response.Headers.Clone()
+		entry.response = &stored
+	})
+}
+
+// Release deletes a claimed key whose request has neither succeeded nor
+// stored a response.
+func (m MemoryIdempotencyModel) Release(ctx context.Context, claim *IdempotencyClaim) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.idempotency[claim.Key]
+	if ok && bytes.Equal(entry.claim, claim.Token) && entry.response == nil && !entry.succeeded {
+		delete(s.idempotency, claim.Key)
+	}
+	return nil
+}
+
+// updateClaim calls update with the entry of a claim that has no stored
+// response, or returns ErrIdempotencyClaimLost when there is none.
+func (m MemoryIdempotencyModel) updateClaim(ctx context.Context, claim *IdempotencyClaim, update func(entry *idempotencyEntry)) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.idempotency[claim.Key]
+	if !ok || !bytes.Equal(entry.claim, claim.Token) || entry.response != nil {
+		return ErrIdempotencyClaimLost
+	}
+	update(entry)
+	return nil
+}
+
+// DeleteExpired removes expired keys.
+func (m MemoryIdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	now := time.Now()
+	for key, entry := range s.idempotency {
+		if !now.Before(entry.expiresAt) {
+			delete(s.idempotency, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+)
+
+// MemoryProductRevisionModel is a ProductRevisionStore backed by a
+// MemoryStore.
+type MemoryProductRevisionModel struct {
+	Store *MemoryStore
+}
+
+// GetAll lists the revisions of a product with sorting and pagination.
+func (m MemoryProductRevisionModel) GetAll(ctx context.Context, productID int64, filters Filters) ([]*ProductRevision, Metadata, error) {
+	if ctx.Err() != nil {
+		return nil, Metadata{}, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	matched := []*ProductRevision{}
+	for _, stored := range s.revisions[productID] {
+		revision := *stored
+		matched = append(matched, &revision)
+	}
+	s.mu.RUnlock()
+
+	order := listingOrder(filters, compareRevisionKey)
+	keys := filters.sortKeys()
+	slices.SortFunc(matched, func(a, b *ProductRevision) int {
+		return order(a, sortValues(keys, b, revisionSortValue))
+	})
+
+	page := paginate(matched, filters, order)
+	revisions, metadata := buildPage(page, filters, len(matched), revisionSortValue)
+	return revisions, metadata, nil
+}
+
+// Get returns the revision that produced a version of a product and the
+// product's fields at that version, like ProductRevisionModel.Get.
+func (m MemoryProductRevisionModel) Get(ctx context.Context, productID int64, version int32) (*ProductRevision, *ProductSnapshot, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	var revisions []*ProductRevision
+	for _, stored := range s.revisions[productID] {
+		if stored.Version <= version {
+			revisions = append(revisions, stored)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(revisions) == 0 || revisions[len(revisions)-1].Version != version {
+		return nil, nil, ErrRecordNotFound
+	}
+	snapshot, err := replayRevisions(revisions)
+	if err != nil {
+		return nil, nil, err
+	}
+	revision := *revisions[len(revisions)-1]
+	return &revision, snapshot, nil
+}
+
+// compareRevisionKey compares a sort key of revision with value.
+func compareRevisionKey(revision *ProductRevision, key, value string) int {
+	version, _ := strconv.ParseInt(value, 10, 32)
+	return cmp.Compare(int64(revision.Version), version)
+}
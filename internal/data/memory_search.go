@@ -0,0 +1,194 @@
+package data
+
+import (
+	"strings"
+	"unicode"
+)
+
+// webSearch is a search query in websearch_to_tsquery syntax, as used by
+// MemoryProductModel: alternatives separated by OR, each made of words and
+// "quoted phrases" that must all appear, or must not when prefixed with
+// "-". Unlike PostgreSQL, words are not stemmed and stop words are kept.
+type webSearch [][]searchTerm
+
+type searchTerm struct {
+	words   []string // consecutive words
+	negated bool
+}
+
+func parseWebSearch(query string) webSearch {
+	var search webSearch
+	var alternative []searchTerm
+
+	for {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+
+		negated := strings.HasPrefix(query, "-")
+		if negated {
+			query = query[1:]
+		}
+
+		var token string
+		if strings.HasPrefix(query, `"`) {
+			phrase, rest, _ := strings.Cut(query[1:], `"`)
+			token, query = phrase, rest
+		} else {
+			end := strings.IndexFunc(query, unicode.IsSpace)
+			if end < 0 {
+				end = len(query)
+			}
+			token, query = query[:end], query[end:]
+			if !negated && strings.EqualFold(token, "or") {
+				if len(alternative) > 0 {
+					search = append(search, alternative)
+					alternative = nil
+				}
+				continue
+			}
+		}
+
+		words := splitWords(token)
+		if len(words) > 0 {
+			alternative = append(alternative, searchTerm{words: words, negated: negated})
+		}
+	}
+	if len(alternative) > 0 {
+		search = append(search, alternative)
+	}
+	return search
+}
+
+// matches reports whether the words of a document satisfy the query.
+func (s webSearch) matches(words []string) bool {
+	for _, alternative := range s {
+		matched := true
+		for _, term := range alternative {
+			if (term.occurrences(words) > 0) == term.negated {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// rank mimics ts_rank_cd with its default weights: every occurrence of a
+// wanted term counts 1.0 in the name and 0.4 in the description.
+func (s webSearch) rank(name, description []string) float64 {
+	var rank float64
+	for _, alternative := range s {
+		for _, term := range alternative {
+			if !term.negated {
+				rank += float64(term.occurrences(name)) + 0.4*float64(term.occurrences(description))
+			}
+		}
+	}
+	return rank
+}
+
+// headline mimics ts_headline: text with the wanted words wrapped in
+// <mark> tags.
+func (s webSearch) headline(text string) string {
+	wanted := make(map[string]bool)
+	for _, alternative := range s {
+		for _, term := range alternative {
+			for _, word := range term.words {
+				wanted[word] = !term.negated
+			}
+		}
+	}
+
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		if wanted[strings.ToLower(word)] {
+			word = "<mark>" + word + "</mark>"
+		}
+		b.WriteString(word)
+		i = j
+	}
+	return b.String()
+}
+
+// occurrences counts the places where the term's words appear in a row.
+func (t searchTerm) occurrences(words []string) int {
+	count := 0
+	for i := 0; i+len(t.words) <= len(words); i++ {
+		found := true
+		for j, word := range t.words {
+			if words[i+j] != word {
+				found = false
+				break
+			}
+		}
+		if found {
+			count++
+		}
+	}
+	return count
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// fuzzySimilarity is the least word similarity at which a fuzzy search
+// matches, like pg_trgm's default word_similarity_threshold.
+const fuzzySimilarity = 0.6
+
+// trigrams returns the set of trigrams of the words of s the way pg_trgm
+// extracts them: lowercased, each word padded with two spaces in front and
+// one behind.
+func trigrams(words []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// wordSimilarity approximates pg_trgm's word_similarity(query, text): the
+// best trigram similarity between the query and a run of consecutive words
+// of text.
+func wordSimilarity(query, text string) float64 {
+	queryWords := splitWords(query)
+	want := trigrams(queryWords)
+	if len(want) == 0 {
+		return 0
+	}
+
+	words := splitWords(text)
+	best := 0.0
+	for i := range words {
+		for j := i + 1; j <= len(words) && j-i <= len(queryWords); j++ {
+			have := trigrams(words[i:j])
+			shared := 0
+			for trigram := range have {
+				if want[trigram] {
+					shared++
+				}
+			}
+			best = max(best, float64(shared)/float64(len(want)+len(have)-shared))
+		}
+	}
+	return best
+}
@@ -0,0 +1,448 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// seedProducts fills store with five products, the first reviewed with 4
+// stars and the third with 2, and returns them in ID order:
+//
+//	1 Red Chair   furniture  50
+//	2 Blue Chair  furniture  30
+//	3 Red Lamp    lighting   30
+//	4 Green Desk  furniture 120
+//	5 Blue Lamp   lighting   15
+func seedProducts(t *testing.T, store *MemoryStore) []*Product {
+	t.Helper()
+	ctx := context.Background()
+
+	products := []*Product{
+		{Name: "Red Chair", Description: "A wooden chair", Category: "furniture", Price: 50},
+		{Name: "Blue Chair", Description: "A plastic chair", Category: "furniture", Price: 30},
+		{Name: "Red Lamp", Description: "A desk lamp", Category: "lighting", Price: 30},
+		{Name: "Green Desk", Description: "An oak desk", Category: "furniture", Price: 120},
+		{Name: "Blue Lamp", Description: "A floor lamp", Category: "lighting", Price: 15},
+	}
+	for _, product := range products {
+		if err := (MemoryProductModel{Store: store}).Insert(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, review := range []*Review{
+		{ProductID: products[0].ID, Content: "Sturdy", Author: "u", Rating: 4},
+		{ProductID: products[2].ID, Content: "Dim", Author: "u", Rating: 2},
+	} {
+		if err := (MemoryReviewModel{Store: store}).Insert(ctx, review); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return products
+}
+
+// productIDs returns the IDs of products, in order.
+func productIDs(products []*Product) []int64 {
+	ids := []int64{}
+	for _, product := range products {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestMemoryProductFilters(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		filter ProductFilter
+		want   []int64
+	}{
+		{"no filter", ProductFilter{}, []int64{1, 2, 3, 4, 5}},
+		{"name words in any case", ProductFilter{Name: "CHAIR"}, []int64{1, 2}},
+		{"name needs every word", ProductFilter{Name: "red chair"}, []int64{1}},
+		{"any of the categories", ProductFilter{Categories: []string{"lighting", "toys"}}, []int64{3, 5}},
+		{"minimum price is inclusive", ProductFilter{MinPrice: 30}, []int64{1, 2, 3, 4}},
+		{"maximum price is inclusive", ProductFilter{MaxPrice: 30}, []int64{2, 3, 5}},
+		{"price range", ProductFilter{MinPrice: 20, MaxPrice: 60}, []int64{1, 2, 3}},
+		{"minimum rating", ProductFilter{MinRating: 3}, []int64{1}},
+		{"with reviews", ProductFilter{HasReviews: &yes}, []int64{1, 3}},
+		{"without reviews", ProductFilter{HasReviews: &no}, []int64{2, 4, 5}},
+		{"search of name and description", ProductFilter{Query: "desk"}, []int64{3, 4}},
+		{"search with alternatives", ProductFilter{Query: "chair or desk"}, []int64{1, 2, 3, 4}},
+		{"search excluding a word", ProductFilter{Query: "lamp -floor"}, []int64{3}},
+		{"combined filters", ProductFilter{Categories: []string{"furniture"}, MaxPrice: 60, Name: "blue"}, []int64{2}},
+	}
+
+	ctx := context.Background()
+	store := NewMemoryStore()
+	seedProducts(t, store)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: ProductSortSafeList, Count: CountExact}
+			products, metadata, err := MemoryProductModel{Store: store}.GetAll(ctx, tt.filter, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := productIDs(products); !slices.Equal(got, tt.want) {
+				t.Errorf("got products %v, want %v", got, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d, want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMemoryProductSorting(t *testing.T) {
+	tests := []struct {
+		sort string
+		want []int64
+	}{
+		{"id", []int64{1, 2, 3, 4, 5}},
+		{"-id", []int64{5, 4, 3, 2, 1}},
+		{"name", []int64{2, 5, 4, 1, 3}},
+		{"price", []int64{5, 2, 3, 1, 4}}, // ties broken by id
+		{"price,-name", []int64{5, 3, 2, 1, 4}},
+		{"-price,name", []int64{4, 1, 2, 3, 5}},
+		{"-review_count,name", []int64{1, 3, 2, 5, 4}},
+		{"-average_rating,-id", []int64{1, 3, 5, 4, 2}},
+	}
+
+	ctx := context.Background()
+	store := NewMemoryStore()
+	seedProducts(t, store)
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 20, Sort: tt.sort, SortSafeList: ProductSortSafeList, Count: CountExact}
+			products, _, err := MemoryProductModel{Store: store}.GetAll(ctx, ProductFilter{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := productIDs(products); !slices.Equal(got, tt.want) {
+				t.Errorf("got products %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryOffsetPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     int
+		count    string
+		want     []int64
+		metadata Metadata
+	}{
+		{
+			name:     "first page",
+			page:     1,
+			count:    CountExact,
+			want:     []int64{5, 2},
+			metadata: Metadata{CurrentPage: 1, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5, Count: CountExact, HasMore: true},
+		},
+		{
+			name:     "middle page",
+			page:     2,
+			count:    CountExact,
+			want:     []int64{3, 1},
+			metadata: Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5, Count: CountExact, HasMore: true},
+		},
+		{
+			name:     "last page",
+			page:     3,
+			count:    CountExact,
+			want:     []int64{4},
+			metadata: Metadata{CurrentPage: 3, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5, Count: CountExact},
+		},
+		{
+			name:     "past the last page",
+			page:     4,
+			count:    CountExact,
+			want:     []int64{},
+			metadata: Metadata{CurrentPage: 4, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5, Count: CountExact},
+		},
+		{
+			name:     "without counting",
+			page:     2,
+			count:    CountNone,
+			want:     []int64{3, 1},
+			metadata: Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, Count: CountNone, HasMore: true},
+		},
+		{
+			name:     "last page without counting",
+			page:     3,
+			count:    CountNone,
+			want:     []int64{4},
+			metadata: Metadata{CurrentPage: 3, PageSize: 2, FirstPage: 1, Count: CountNone},
+		},
+	}
+
+	ctx := context.Background()
+	store := NewMemoryStore()
+	seedProducts(t, store)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: tt.page, PageSize: 2, Sort: "price", SortSafeList: ProductSortSafeList, Count: tt.count}
+			products, metadata, err := MemoryProductModel{Store: store}.GetAll(ctx, ProductFilter{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := productIDs(products); !slices.Equal(got, tt.want) {
+				t.Errorf("got products %v, want %v", got, tt.want)
+			}
+			if metadata.next.IsZero() == metadata.HasMore && len(products) > 0 {
+				t.Errorf("got next position %v with has_more %t", metadata.next, metadata.HasMore)
+			}
+			if metadata.prev.IsZero() != (tt.page == 1 || len(products) == 0) {
+				t.Errorf("got previous position %v on page %d", metadata.prev, tt.page)
+			}
+			metadata.next, metadata.prev = Cursor{}, Cursor{}
+			if !reflect.DeepEqual(metadata, tt.metadata) {
+				t.Errorf("got metadata %+v, want %+v", metadata, tt.metadata)
+			}
+		})
+	}
+}
+
+func TestMemoryCursorPagination(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	seedProducts(t, store)
+
+	list := func(cursor Cursor) ([]int64, Metadata) {
+		t.Helper()
+		filters := Filters{Page: 1, PageSize: 2, Sort: "price,-name", SortSafeList: ProductSortSafeList, Cursor: cursor, Count: CountNone}
+		products, metadata, err := MemoryProductModel{Store: store}.GetAll(ctx, ProductFilter{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return productIDs(products), metadata
+	}
+
+	// The first page is read by page number, the others by cursor
+	ids, first := list(Cursor{})
+	if want := []int64{5, 3}; !slices.Equal(ids, want) {
+		t.Fatalf("first page: got %v, want %v", ids, want)
+	}
+	if !first.prev.IsZero() {
+		t.Errorf("first page: got previous position %v", first.prev)
+	}
+
+	// Rows added before the cursor do not shift the pages after it
+	err := MemoryProductModel{Store: store}.Insert(ctx, &Product{Name: "Cheap Stool", Description: "d", Category: "furniture", Price: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, second := list(first.next)
+	if want := []int64{2, 1}; !slices.Equal(ids, want) {
+		t.Fatalf("second page: got %v, want %v", ids, want)
+	}
+	if !second.HasMore || second.CurrentPage != 0 || second.FirstPage != 0 {
+		t.Errorf("second page: got metadata %+v", second)
+	}
+
+	ids, last := list(second.next)
+	if want := []int64{4}; !slices.Equal(ids, want) {
+		t.Fatalf("last page: got %v, want %v", ids, want)
+	}
+	if last.HasMore || !last.next.IsZero() {
+		t.Errorf("last page: got has_more %t and next position %v", last.HasMore, last.next)
+	}
+
+	// Going back returns the same pages, in the same order
+	ids, back := list(last.prev)
+	if want := []int64{2, 1}; !slices.Equal(ids, want) {
+		t.Fatalf("back to the second page: got %v, want %v", ids, want)
+	}
+	if !back.HasMore {
+		t.Errorf("back to the second page: has_more is false")
+	}
+	ids, _ = list(back.prev)
+	if want := []int64{5, 3}; !slices.Equal(ids, want) {
+		t.Fatalf("back to the first page: got %v, want %v", ids, want)
+	}
+	if want := "price,-name"; back.prev.Sort != want || !back.prev.Backward {
+		t.Errorf("got previous position %+v, want a backward one for %q", back.prev, want)
+	}
+}
+
+func TestMemoryVersionConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	products := seedProducts(t, store)
+	productModel := MemoryProductModel{Store: store}
+	reviewModel := MemoryReviewModel{Store: store}
+
+	// Two clients read the same product; the second write loses
+	first, err := productModel.Get(ctx, products[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := *first
+	first.Price = 35
+	if err := productModel.Update(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != second.Version+1 {
+		t.Errorf("got version %d after an update, want %d", first.Version, second.Version+1)
+	}
+	second.Price = 25
+	if err := productModel.Update(ctx, &second); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("update of a stale product: got %v, want ErrEditConflict", err)
+	}
+	if err := productModel.Delete(ctx, second.ID, second.Version); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("delete of a stale product: got %v, want ErrEditConflict", err)
+	}
+
+	// Products in the trash cannot be read or written
+	if err := productModel.Delete(ctx, first.ID, first.Version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := productModel.Get(ctx, first.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("get of a deleted product: got %v, want ErrRecordNotFound", err)
+	}
+	if err := productModel.Update(ctx, first); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("update of a deleted product: got %v, want ErrEditConflict", err)
+	}
+
+	// Reviews work the same way
+	reviews, _, err := MemoryReviewModel{Store: store}.GetAll(ctx, products[0].ID, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: ReviewSortSafeList, Count: CountExact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews) != 1 {
+		t.Fatalf("got %d reviews, want 1", len(reviews))
+	}
+	review := reviews[0]
+	stale := *review
+	review.Rating = 5
+	if err := reviewModel.Update(ctx, review); err != nil {
+		t.Fatal(err)
+	}
+	if err := reviewModel.Update(ctx, &stale); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("update of a stale review: got %v, want ErrEditConflict", err)
+	}
+	if err := reviewModel.Delete(ctx, stale.ProductID, stale.ID, stale.Version); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("delete of a stale review: got %v, want ErrEditConflict", err)
+	}
+	if err := reviewModel.Delete(ctx, review.ProductID, review.ID, review.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := reviewModel.Update(ctx, review); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("update of a deleted review: got %v, want ErrEditConflict", err)
+	}
+}
+
+func TestMemoryRollbackKeepsOutsideWrites(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels(NewMemoryStore())
+
+	outside := &Product{Name: "Outside", Description: "d", Category: "c", Price: 1}
+	done := make(chan error, 1)
+	errRollback := errors.New("rollback")
+
+	err := models.WithTx(ctx, func(tx Models) error {
+		err := tx.Products.Insert(ctx, &Product{Name: "Inside", Description: "d", Category: "c", Price: 1})
+		if err != nil {
+			return err
+		}
+		go func() { done <- models.Products.Insert(ctx, outside) }()
+		select {
+		case <-done:
+			t.Fatal("insert outside the transaction finished while it ran")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithTx returned %v, want %v", err, errRollback)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	products, _, err := models.Products.GetAll(ctx, ProductFilter{}, Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: ProductSortSafeList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].Name != "Outside" {
+		t.Fatalf("got %d products after the rollback, want only the one inserted outside the transaction", len(products))
+	}
+}
+
+func TestMemoryReviewsKeepProductVersion(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels(NewMemoryStore())
+
+	product := &Product{Name: "A", Description: "d", Category: "c", Price: 1}
+	if err := models.Products.Insert(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	review := &Review{ProductID: product.ID, Content: "good", Author: "u", Rating: 4}
+	if err := models.Reviews.Insert(ctx, review); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.Products.Get(ctx, product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != product.Version || got.ReviewCount != 1 || got.AverageRating != 4 {
+		t.Fatalf("got version %d with %d reviews rated %v, want version %d with 1 review rated 4", got.Version, got.ReviewCount, got.AverageRating, product.Version)
+	}
+
+	// An edit based on the version read before the review still applies
+	product.Name = "B"
+	if err := models.Products.Update(ctx, product); err != nil {
+		t.Fatalf("update after a review: %v", err)
+	}
+}
+
+func TestMemoryIdempotencyClaims(t *testing.T) {
+	ctx := context.Background()
+	store := MemoryIdempotencyModel{Store: NewMemoryStore()}
+	key := IdempotencyKey{UserID: 1, Key: "key-1"}
+	request := IdempotentRequest{Endpoint: "POST /v1/products", Fingerprint: []byte{1}}
+
+	first, _, err := store.Begin(ctx, key, request, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Release(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := store.Begin(ctx, key, request, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first claim no longer holds the key
+	if err := store.Release(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Complete(ctx, first, &IdempotentResponse{Status: 201}); !errors.Is(err, ErrIdempotencyClaimLost) {
+		t.Fatalf("Complete with a lost claim returned %v, want %v", err, ErrIdempotencyClaimLost)
+	}
+	if err := store.Renew(ctx, first); !errors.Is(err, ErrIdempotencyClaimLost) {
+		t.Fatalf("Renew with a lost claim returned %v, want %v", err, ErrIdempotencyClaimLost)
+	}
+
+	// A succeeded request keeps its key even without a response
+	if err := store.Succeed(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Release(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	store.Store.idempotency[key].lockedUntil = time.Now().Add(-time.Second)
+	if _, _, err := store.Begin(ctx, key, request, time.Hour); !errors.Is(err, ErrIdempotencyResponseLost) {
+		t.Fatalf("Begin after a success without a response returned %v, want %v", err, ErrIdempotencyResponseLost)
+	}
+}
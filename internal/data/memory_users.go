@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MemoryUserModel is a UserStore backed by a MemoryStore.
+type MemoryUserModel struct {
+	Store *MemoryStore
+	inTx  bool
+}
+
+// MemoryTokenModel is a TokenStore backed by a MemoryStore.
+type MemoryTokenModel struct {
+	Store *MemoryStore
+	inTx  bool
+}
+
+// MemoryPermissionModel is a PermissionStore backed by a MemoryStore.
+type MemoryPermissionModel struct {
+	Store *MemoryStore
+	inTx  bool
+}
+
+// Insert adds a new user. Email addresses are unique regardless of case,
+// like the citext column in PostgreSQL.
+func (m MemoryUserModel) Insert(ctx context.Context, user *User) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	if s.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	s.nextUserID++
+	user.ID = s.nextUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+
+	stored := *user
+	stored.Password.plaintext = nil
+	s.users[user.ID] = &stored
+	return nil
+}
+
+// Get retrieves a specific user by ID.
+func (m MemoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	user := *stored
+	return &user, nil
+}
+
+// GetByEmail retrieves a specific user by email address.
+func (m MemoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, stored := range s.users {
+		if strings.EqualFold(stored.Email, email) {
+			user := *stored
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+// GetForToken retrieves the user owning an unexpired token of the given scope.
+func (m MemoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	stored, ok := s.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	user := *stored
+	return &user, nil
+}
+
+// Update replaces the stored user, provided its version still matches.
+func (m MemoryUserModel) Update(ctx context.Context, user *User) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	stored, ok := s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+	if s.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+	user.Version++
+
+	updated := *user
+	updated.Password.plaintext = nil
+	s.users[user.ID] = &updated
+	return nil
+}
+
+// emailTaken reports whether another user already has the email address.
+// The caller must hold s.mu.
+func (s *MemoryStore) emailTaken(email string, exceptID int64) bool {
+	for id, user := range s.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// New generates a token and stores it keyed by its hash.
+func (m MemoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	stored := *token
+	stored.Plaintext = ""
+	s.tokens[string(token.Hash)] = &stored
+	return token, nil
+}
+
+// DeleteAllForUser removes every token of a scope belonging to a user.
+func (m MemoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	for hash, token := range s.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// GetAllForUser returns every permission code granted to a user.
+func (m MemoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	s := m.Store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.permissions[userID]), nil
+}
+
+// AddForUser grants the given permission codes to a user. Codes the user
+// already holds are ignored.
+func (m MemoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s := m.Store
+	defer s.lock(m.inTx)()
+
+	for _, code := range codes {
+		// Like the PostgreSQL query, unknown codes are skipped
+		if slices.Contains(PermissionCodes, code) && !s.permissions[userID].Include(code) {
+			s.permissions[userID] = append(s.permissions[userID], code)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxTxAttempts bounds how many times WithTx runs a transaction that keeps
+// failing with serialization failures or deadlocks.
+const maxTxAttempts = 5
+
+// DBTX is what the PostgreSQL models run their statements on: the
+// connection pool or a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Models groups the product, review, product revision, audit log, user,
+// token and permission stores so that handlers can combine their operations
+// in a single transaction with WithTx.
+type Models struct {
+	Products    ProductStore
+	Reviews     ReviewStore
+	Revisions   ProductRevisionStore
+	Audit       AuditStore
+	Users       UserStore
+	Tokens      TokenStore
+	Permissions PermissionStore
+
+	// runTx starts transactions; it is nil for the Models handed to a
+	// WithTx function, whose operations already run in one
+	runTx func(ctx context.Context, fn func(tx Models) error) error
+}
+
+// NewModels returns the PostgreSQL models. Their transactions run at the
+// REPEATABLE READ isolation level.
+func NewModels(db *sql.DB, searchLanguage string, timeouts QueryTimeouts) Models {
+	models := newModels(db, searchLanguage, timeouts)
+	models.runTx = func(ctx context.Context, fn func(tx Models) error) error {
+		return retryTx(ctx, func() error {
+			tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			err = fn(newModels(tx, searchLanguage, timeouts))
+			if err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+	}
+	return models
+}
+
+func newModels(db DBTX, searchLanguage string, timeouts QueryTimeouts) Models {
+	return Models{
+		Products:    ProductModel{DB: db, SearchLanguage: searchLanguage, Timeouts: timeouts},
+		Reviews:     ReviewModel{DB: db, Timeouts: timeouts},
+		Revisions:   ProductRevisionModel{DB: db, Timeouts: timeouts},
+		Audit:       AuditModel{DB: db, Timeouts: timeouts},
+		Users:       UserModel{DB: db, Timeouts: timeouts},
+		Tokens:      TokenModel{DB: db, Timeouts: timeouts},
+		Permissions: PermissionModel{DB: db, Timeouts: timeouts},
+	}
+}
+
+// NewMemoryModels returns the models backed by store. Their transactions
+// run one at a time and are rolled back by restoring a snapshot of the
+// store, idempotency keys aside. Writes made outside
+// transactions wait for the running one to finish, so a rollback only ever
+// undoes the transaction's own writes; reads do not wait, and can see the
+// writes of a transaction before it commits.
+func NewMemoryModels(store *MemoryStore) Models {
+	models := Models{
+		Products:    MemoryProductModel{Store: store},
+		Reviews:     MemoryReviewModel{Store: store},
+		Revisions:   MemoryProductRevisionModel{Store: store},
+		Audit:       MemoryAuditModel{Store: store},
+		Users:       MemoryUserModel{Store: store},
+		Tokens:      MemoryTokenModel{Store: store},
+		Permissions: MemoryPermissionModel{Store: store},
+	}
+	txModels := Models{
+		Products:    MemoryProductModel{Store: store, inTx: true},
+		Reviews:     MemoryReviewModel{Store: store, inTx: true},
+		Revisions:   models.Revisions,
+		Audit:       models.Audit,
+		Users:       MemoryUserModel{Store: store, inTx: true},
+		Tokens:      MemoryTokenModel{Store: store, inTx: true},
+		Permissions: MemoryPermissionModel{Store: store, inTx: true},
+	}
+	models.runTx = func(ctx context.Context, fn func(tx Models) error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		store.txMu.Lock()
+		defer store.txMu.Unlock()
+
+		snapshot := store.snapshot()
+		err := fn(txModels)
+		if err != nil {
+			store.restore(snapshot)
+		}
+		return err
+	}
+	return models
+}
+
+// WithTx runs fn with models whose operations all happen in one
+// transaction, committed when fn returns nil and rolled back otherwise.
+// Transactions that fail with a serialization failure or a deadlock are run
+// again, so fn must not have effects outside the models. Calling WithTx on
+// the models passed to fn joins the running transaction.
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.runTx == nil {
+		return fn(m)
+	}
+	return m.runTx(ctx, fn)
+}
+
+// retryTx calls attempt until it succeeds, fails with an error other than a
+// serialization failure or deadlock, or has been called maxTxAttempts
+// times. Attempts are spaced by a growing, randomized delay.
+func retryTx(ctx context.Context, attempt func() error) error {
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || i == maxTxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		delay := time.Duration(rand.Int64N(int64(10*time.Millisecond) << i))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable reports whether err aborted a transaction that may succeed
+// when run again.
+func isRetryable(err error) bool {
+	var pgErr *pq.Error
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || // serialization_failure
+		pgErr.Code == "40P01" // deadlock_detected
+}
+
+// transaction runs fn in the transaction db belongs to or, when db is the
+// connection pool, in a new transaction that is committed when fn succeeds.
+func transaction(ctx context.Context, db DBTX, fn func(tx *sql.Tx) error) error {
+	switch db := db.(type) {
+	case *sql.Tx:
+		return fn(db)
+	case *sql.DB:
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	default:
+		return errors.New("transactions need a *sql.DB or *sql.Tx")
+	}
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// Permission codes
+const (
+	PermissionProductsRead    = "products:read"
+	PermissionProductsWrite   = "products:write"
+	PermissionReviewsWrite    = "reviews:write"
+	PermissionReviewsModerate = "reviews:moderate"
+	PermissionAuditRead       = "audit:read"
+)
+
+// PermissionCodes lists every permission that exists.
+var PermissionCodes = []string{PermissionProductsRead, PermissionProductsWrite, PermissionReviewsWrite, PermissionReviewsModerate, PermissionAuditRead}
+
+// DefaultPermissions are granted to every newly registered user.
+var DefaultPermissions = []string{PermissionProductsRead, PermissionReviewsWrite}
+
+// Permissions holds the permission codes granted to a single user.
+type Permissions []string
+
+// Include reports whether code is one of the permissions.
+func (p Permissions) Include(code string) bool {
+	return slices.Contains(p, code)
+}
+
+// PermissionStore is the set of operations the handlers need from a
+// permission storage backend. PermissionModel (PostgreSQL) and
+// MemoryPermissionModel both satisfy it.
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+// PermissionModel struct wraps the DB connection pool, or a transaction.
+type PermissionModel struct {
+	DB       DBTX
+	Timeouts QueryTimeouts
+}
+
+// GetAllForUser returns every permission code granted to a user.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+	`
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// AddForUser grants the given permission codes to a user. Codes the user
+// already holds are ignored.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
@@ -5,29 +5,93 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/martinezmoises/Test1/internal/validator"
 )
 
-var ErrRecordNotFound = errors.New("record not found")
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrEditConflict   = errors.New("edit conflict")
+)
 
 // Product struct represents a product with various attributes.
 type Product struct {
-	ID            int64     `json:"id"`
-	Name          string    `json:"name"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category"`
-	Price         float64   `json:"price"`
-	ImageURL      string    `json:"image_url"`
-	AverageRating float64   `json:"average_rating"`
-	CreatedAt     time.Time `json:"-"`
-	Version       int32     `json:"version"`
-}
-
-// ProductModel struct wraps the DB connection pool.
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Category      string     `json:"category"`
+	Price         float64    `json:"price"`
+	ImageURL      string     `json:"image_url"`
+	AverageRating float64    `json:"average_rating"`
+	ReviewCount   int        `json:"review_count"`
+	Rank          float64    `json:"rank,omitempty"`     // search relevance, only set by searches
+	Headline      string     `json:"headline,omitempty"` // search snippet, only set by searches
+	CreatedAt     time.Time  `json:"-"`
+	UpdatedAt     time.Time  `json:"-"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"` // only set on products in the trash
+	Version       int32      `json:"version"`
+}
+
+// ProductStore is the set of operations the handlers need from a product
+// storage backend. ProductModel (PostgreSQL) and MemoryProductModel both
+// satisfy it. Operations stop when ctx is done.
+type ProductStore interface {
+	Insert(ctx context.Context, product *Product) error
+	Get(ctx context.Context, id int64) (*Product, error)
+	Update(ctx context.Context, product *Product) error
+	Delete(ctx context.Context, id int64, version int32) error
+	GetAll(ctx context.Context, filter ProductFilter, filters Filters) ([]*Product, Metadata, error)
+	Facets(ctx context.Context, filter ProductFilter, names []string) (Facets, error)
+	Suggest(ctx context.Context, prefix string, limit int) ([]*ProductSuggestion, error)
+	GetDeleted(ctx context.Context, filters Filters) ([]*Product, Metadata, error)
+	Restore(ctx context.Context, id int64) (*Product, error)
+}
+
+// ProductSuggestion is a completion of a partially typed product name.
+type ProductSuggestion struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// ProductFilter restricts a product listing. Zero-valued fields do not
+// restrict it.
+type ProductFilter struct {
+	Query         string   // ranked search of name and description, in websearch_to_tsquery syntax
+	Name          string   // full-text match on the name
+	Categories    []string // any of these categories
+	MinPrice      float64
+	MaxPrice      float64
+	MinRating     float64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	HasReviews    *bool
+
+	// fuzzy switches Query to typo-tolerant matching of names and
+	// categories. GetAll sets it when the full-text search finds nothing.
+	fuzzy bool
+}
+
+// DefaultSearchLanguage is the text search configuration used when
+// ProductModel.SearchLanguage is empty.
+const DefaultSearchLanguage = "english"
+
+// ProductModel struct wraps the DB connection pool, or a transaction.
 type ProductModel struct {
-	DB *sql.DB
+	DB             DBTX
+	SearchLanguage string // PostgreSQL text search configuration, such as "english"
+	Timeouts       QueryTimeouts
+}
+
+func (p ProductModel) searchLanguage() string {
+	if p.SearchLanguage == "" {
+		return DefaultSearchLanguage
+	}
+	return p.SearchLanguage
 }
 
 // ValidateProduct checks the fields of the Product struct.
@@ -39,48 +103,171 @@ func ValidateProduct(v *validator.Validator, product *Product) {
 	v.Check(product.Category != "", "category", "must be provided")
 	v.Check(product.Price > 0, "price", "must be a positive number")
 	v.Check(len(product.ImageURL) <= 255, "image_url", "must not be more than 255 characters long")
-	v.Check(product.AverageRating >= 0 && product.AverageRating <= 5, "average_rating", "must be between 0 and 5")
+}
+
+// ValidateProductFilter checks the values of a product listing filter.
+// Errors are keyed by query parameter.
+func ValidateProductFilter(v *validator.Validator, filter ProductFilter) {
+	for _, category := range filter.Categories {
+		v.Check(category != "", "category", "must not contain empty values")
+	}
+	v.Check(len(filter.Categories) <= 20, "category", "must not contain more than 20 values")
+	v.Check(len(filter.Query) <= 200, "q", "must not be more than 200 characters long")
+	v.Check(filter.MinPrice >= 0, "min_price", "must not be negative")
+	v.Check(filter.MaxPrice >= 0, "max_price", "must not be negative")
+	if filter.MinPrice > 0 && filter.MaxPrice > 0 {
+		v.Check(filter.MaxPrice >= filter.MinPrice, "max_price", "must not be less than min_price")
+	}
+	v.Check(filter.MinRating >= 0 && filter.MinRating <= 5, "min_rating", "must be between 0 and 5")
+	if !filter.CreatedAfter.IsZero() && !filter.CreatedBefore.IsZero() {
+		v.Check(filter.CreatedBefore.After(filter.CreatedAfter), "created_before", "must be later than created_after")
+	}
+}
+
+// ProductFieldSafeList lists the product fields a fields parameter may
+// select, named as in JSON.
+var ProductFieldSafeList = []string{
+	"id", "name", "description", "category", "price", "image_url",
+	"average_rating", "review_count", "rank", "headline", "version",
+}
+
+// ProductIncludeSafeList lists the related resources an include parameter
+// may embed in products.
+var ProductIncludeSafeList = []string{"reviews"}
+
+// MaxEmbeddedReviews bounds the reviews_limit parameter.
+const MaxEmbeddedReviews = 10
+
+// ValidateProductShape checks the fields, include and reviews_limit
+// parameters that shape product representations.
+func ValidateProductShape(v *validator.Validator, fields, include []string, reviewsLimit int) {
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, ProductFieldSafeList...), "fields", "must only contain "+strings.Join(ProductFieldSafeList, ", "))
+	}
+	for _, related := range include {
+		v.Check(validator.PermittedValue(related, ProductIncludeSafeList...), "include", "must only contain "+strings.Join(ProductIncludeSafeList, ", "))
+	}
+	v.Check(reviewsLimit > 0, "reviews_limit", "must be greater than zero")
+	v.Check(reviewsLimit <= MaxEmbeddedReviews, "reviews_limit", fmt.Sprintf("must be a maximum of %d", MaxEmbeddedReviews))
+}
+
+// ValidateSuggestion checks the parameters of a name completion request.
+func ValidateSuggestion(v *validator.Validator, prefix string, limit int) {
+	v.Check(strings.TrimSpace(prefix) != "", "prefix", "must be provided")
+	v.Check(len(prefix) <= 100, "prefix", "must not be more than 100 characters long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+}
+
+// where returns the FROM list and the condition selecting the products that
+// pass the filter, with placeholders numbered from $1, and their arguments.
+// Products in the trash never pass.
+// With a search query the FROM list defines "query", the parsed tsquery; a
+// fuzzy search passes the raw query as $1 instead.
+func (f ProductFilter) where(language string) (from, where string, args []any) {
+	conditions := []string{"deleted_at IS NULL"}
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	from = "products"
+	switch {
+	case f.Query != "" && f.fuzzy:
+		// <% compares the query with the most similar run of words and can
+		// use the trigram indexes
+		args = append(args, f.Query)
+		conditions = append(conditions, "($1 <% name OR $1 <% category)")
+	case f.Query != "":
+		args = append(args, language, f.Query)
+		from = "products, websearch_to_tsquery($1::regconfig, $2) AS query"
+		conditions = append(conditions, "search_vector @@ query")
+	}
+	if f.Name != "" {
+		add("to_tsvector('simple', name) @@ plainto_tsquery('simple', $%d)", f.Name)
+	}
+	if len(f.Categories) > 0 {
+		add("category = ANY($%d)", pq.Array(f.Categories))
+	}
+	if f.MinPrice > 0 {
+		add("price >= $%d", f.MinPrice)
+	}
+	if f.MaxPrice > 0 {
+		add("price <= $%d", f.MaxPrice)
+	}
+	if f.MinRating > 0 {
+		add("average_rating >= $%d", f.MinRating)
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at > $%d", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at < $%d", f.CreatedBefore)
+	}
+	if f.HasReviews != nil {
+		if *f.HasReviews {
+			conditions = append(conditions, "review_count > 0")
+		} else {
+			conditions = append(conditions, "review_count = 0")
+		}
+	}
+
+	return from, strings.Join(conditions, "\n\t\tAND "), args
 }
 
 // Insert inserts a new product into the database and returns the created product ID, creation time, and version.
-func (p ProductModel) Insert(product *Product) error {
+// A new product has no reviews, so its rating starts at zero. Its first
+// revision is recorded in the same transaction.
+func (p ProductModel) Insert(ctx context.Context, product *Product) error {
 	query := `
-		INSERT INTO products (name, description, category, price, image_url, average_rating)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, created_at, version
+		INSERT INTO products (name, description, category, price, image_url, search_vector)
+		VALUES ($1, $2, $3, $4, $5, products_search_vector($6, $1, $2))
+		RETURNING id, created_at, updated_at, average_rating, review_count, version
 	`
-	args := []any{product.Name, product.Description, product.Category, product.Price, product.ImageURL, product.AverageRating}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{product.Name, product.Description, product.Category, product.Price, product.ImageURL, p.searchLanguage()}
+	ctx, cancel := p.Timeouts.write(ctx)
 	defer cancel()
 
-	return p.DB.QueryRowContext(ctx, query, args...).Scan(&product.ID, &product.CreatedAt, &product.Version)
+	return transaction(ctx, p.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt, &product.AverageRating, &product.ReviewCount, &product.Version)
+		if err != nil {
+			return err
+		}
+		err = insertRevision(ctx, tx, product.ID, product.Version, snapshotOf(product).values())
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceProduct, product.ID, AuditActionCreate, nil, product)
+	})
 }
 
 // Get retrieves a specific product by ID.
-func (p ProductModel) Get(id int64) (*Product, error) {
+func (p ProductModel) Get(ctx context.Context, id int64) (*Product, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT id, created_at, name, description, category, price, image_url, average_rating, version
+		SELECT id, created_at, updated_at, name, description, category, price, image_url, average_rating, review_count, version
 		FROM products
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	var product Product
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := p.Timeouts.read(ctx)
 	defer cancel()
 
 	err := p.DB.QueryRowContext(ctx, query, id).Scan(
 		&product.ID,
 		&product.CreatedAt,
+		&product.UpdatedAt,
 		&product.Name,
 		&product.Description,
 		&product.Category,
 		&product.Price,
 		&product.ImageURL,
 		&product.AverageRating,
+		&product.ReviewCount,
 		&product.Version,
 	)
 	if err != nil {
@@ -92,85 +279,388 @@ func (p ProductModel) Get(id int64) (*Product, error) {
 	return &product, nil
 }
 
-// Update modifies an existing product in the database.
-func (p ProductModel) Update(product *Product) error {
+// Update modifies an existing product in the database. The update only
+// succeeds if the stored version still matches product.Version; otherwise
+// ErrEditConflict is returned. average_rating and review_count are
+// maintained from the reviews table and are never written here. A revision
+// holding the changed fields and an audit event are recorded in the same
+// transaction.
+func (p ProductModel) Update(ctx context.Context, product *Product) error {
 	query := `
 		UPDATE products
-		SET name = $1, description = $2, category = $3, price = $4, image_url = $5, average_rating = $6, version = version + 1
-		WHERE id = $7
-		RETURNING version
+		SET name = $1, description = $2, category = $3, price = $4, image_url = $5, version = version + 1, updated_at = NOW(),
+			search_vector = products_search_vector($7, $1, $2)
+		WHERE id = $6
+		RETURNING version, updated_at, average_rating, review_count
 	`
-	args := []any{product.Name, product.Description, product.Category, product.Price, product.ImageURL, product.AverageRating, product.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{product.Name, product.Description, product.Category, product.Price, product.ImageURL, product.ID, p.searchLanguage()}
+	ctx, cancel := p.Timeouts.write(ctx)
 	defer cancel()
 
-	return p.DB.QueryRowContext(ctx, query, args...).Scan(&product.Version)
+	return transaction(ctx, p.DB, func(tx *sql.Tx) error {
+		before, err := lockProductRow(ctx, tx, "id = $1 AND version = $2 AND deleted_at IS NULL", product.ID, product.Version)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrEditConflict
+			}
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&product.Version, &product.UpdatedAt, &product.AverageRating, &product.ReviewCount)
+		if err != nil {
+			return err
+		}
+		err = insertRevision(ctx, tx, product.ID, product.Version, revisionChanges(snapshotOf(before), snapshotOf(product)))
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceProduct, product.ID, AuditActionUpdate, before, product)
+	})
 }
 
-// Delete removes a product from the database by ID.
-func (p ProductModel) Delete(id int64) error {
+// Delete moves a product to the trash, provided it is still at the given
+// version, along with its reviews, and records an audit event. A missing
+// row is reported as ErrEditConflict because the caller has already read
+// the product.
+func (p ProductModel) Delete(ctx context.Context, id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-		DELETE FROM products
+		UPDATE products
+		SET deleted_at = NOW(), version = version + 1, updated_at = NOW()
+		WHERE id = $1
+	`
+	// Restoring the product brings back these reviews, but not the ones
+	// deleted before
+	reviewsQuery := `
+		UPDATE reviews
+		SET deleted_at = NOW(), deleted_with_product = TRUE, version = version + 1, updated_at = NOW()
+		WHERE product_id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := p.Timeouts.write(ctx)
+	defer cancel()
+
+	return transaction(ctx, p.DB, func(tx *sql.Tx) error {
+		before, err := lockProductRow(ctx, tx, "id = $1 AND version = $2 AND deleted_at IS NULL", id, version)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrEditConflict
+			}
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, reviewsQuery, id)
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceProduct, id, AuditActionDelete, before, nil)
+	})
+}
+
+// Restore takes a product out of the trash, together with the reviews that
+// were deleted with it, and returns it. ErrRecordNotFound is returned if
+// the product is not in the trash. Its rating is still that of these
+// reviews, which cannot change while they are in the trash. An audit event
+// is recorded in the same transaction.
+func (p ProductModel) Restore(ctx context.Context, id int64) (*Product, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE products
+		SET deleted_at = NULL, version = version + 1, updated_at = NOW()
 		WHERE id = $1
+		RETURNING id, created_at, updated_at, name, description, category, price, image_url, average_rating, review_count, version
+	`
+	reviewsQuery := `
+		UPDATE reviews
+		SET deleted_at = NULL, deleted_with_product = FALSE, version = version + 1, updated_at = NOW()
+		WHERE product_id = $1 AND deleted_with_product
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := p.Timeouts.write(ctx)
 	defer cancel()
 
-	result, err := p.DB.ExecContext(ctx, query, id)
+	var product Product
+	err := transaction(ctx, p.DB, func(tx *sql.Tx) error {
+		before, err := lockProductRow(ctx, tx, "id = $1 AND deleted_at IS NOT NULL", id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		err = tx.QueryRowContext(ctx, query, id).Scan(
+			&product.ID,
+			&product.CreatedAt,
+			&product.UpdatedAt,
+			&product.Name,
+			&product.Description,
+			&product.Category,
+			&product.Price,
+			&product.ImageURL,
+			&product.AverageRating,
+			&product.ReviewCount,
+			&product.Version,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, reviewsQuery, id)
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceProduct, id, AuditActionRestore, before, &product)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &product, nil
+}
 
-	rowsAffected, err := result.RowsAffected()
+// lockProductRow reads the product selected by condition, whose
+// placeholders are numbered from $1, and takes a row lock on it.
+// sql.ErrNoRows is returned if no product is selected.
+func lockProductRow(ctx context.Context, tx *sql.Tx, condition string, args ...any) (*Product, error) {
+	query := `
+		SELECT id, created_at, updated_at, deleted_at, name, description, category, price, image_url, average_rating, review_count, version
+		FROM products
+		WHERE ` + condition + `
+		FOR UPDATE
+	`
+	var product Product
+	err := tx.QueryRowContext(ctx, query, args...).Scan(
+		&product.ID,
+		&product.CreatedAt,
+		&product.UpdatedAt,
+		&product.DeletedAt,
+		&product.Name,
+		&product.Description,
+		&product.Category,
+		&product.Price,
+		&product.ImageURL,
+		&product.AverageRating,
+		&product.ReviewCount,
+		&product.Version,
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return &product, nil
+}
+
+// GetDeleted retrieves the products in the trash, with sorting and
+// pagination.
+func (p ProductModel) GetDeleted(ctx context.Context, filters Filters) ([]*Product, Metadata, error) {
+	where := "deleted_at IS NOT NULL"
+	var args []any
+
+	ctx, cancel := p.Timeouts.list(ctx)
+	defer cancel()
+
+	// See GetAll
+	total := "0"
+	totalRecords := 0
+	if filters.windowCount() {
+		total = "COUNT(*) OVER()"
+	} else if filters.Count != CountNone {
+		var err error
+		totalRecords, err = countRows(ctx, p.DB, "products", where, args, filters.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
 	}
 
-	return nil
-}
+	offset := filters.offset()
+	if !filters.Cursor.IsZero() {
+		condition, cursorArgs := filters.keysetCondition(len(args) + 1)
+		where += " AND " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+	args = append(args, filters.limit(), offset)
 
-// GetAll retrieves all products, with filtering, sorting, and pagination.
-func (p ProductModel) GetAll(name, category string, filters Filters) ([]*Product, Metadata, error) {
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, name, description, category, price, image_url, average_rating, version
+		SELECT %s, id, created_at, updated_at, deleted_at, name, description, category, price, image_url, average_rating, review_count, version
 		FROM products
-		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (category = $2 OR $2 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, where, filters.orderBy(), len(args)-1, len(args))
+
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	windowTotal := 0
+	products := []*Product{}
+
+	for rows.Next() {
+		var product Product
+		err := rows.Scan(
+			&windowTotal,
+			&product.ID,
+			&product.CreatedAt,
+			&product.UpdatedAt,
+			&product.DeletedAt,
+			&product.Name,
+			&product.Description,
+			&product.Category,
+			&product.Price,
+			&product.ImageURL,
+			&product.AverageRating,
+			&product.ReviewCount,
+			&product.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		products = append(products, &product)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if filters.windowCount() {
+		totalRecords = windowTotal
+	}
+
+	products, metadata := buildPage(products, filters, totalRecords, productSortValue)
+	return products, metadata, nil
+}
+
+// Purge permanently removes the products that have been in the trash for
+// longer than retention, along with their reviews, and returns how many
+// products were removed. Each removal, of a product or of one of its
+// reviews, is recorded as an audit event made by the actor of ctx, each
+// product followed by its reviews; the records as they were deleted are in
+// the events of the deletes.
+func (p ProductModel) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	// The reviews are removed by the cascade, after the statement has read
+	// them
+	query := `
+		WITH purged AS (
+			DELETE FROM products
+			WHERE deleted_at <= NOW() - $1::float8 * INTERVAL '1 millisecond'
+			RETURNING id
+		), events AS (
+			INSERT INTO audit_events (actor_id, client_ip, request_id, resource, resource_id, action)
+			SELECT NULLIF($2::bigint, 0), NULLIF($3, ''), NULLIF($4, ''), removed.resource, removed.id, $7::text
+			FROM (
+				SELECT $5::text AS resource, id, id AS product_id
+				FROM purged
+				UNION ALL
+				SELECT $6::text, reviews.id, reviews.product_id
+				FROM reviews
+				INNER JOIN purged ON reviews.product_id = purged.id
+			) AS removed
+			ORDER BY removed.product_id, removed.resource <> $5::text, removed.id
+		)
+		SELECT COUNT(*) FROM purged
+	`
+	ctx, cancel := p.Timeouts.maintenance(ctx)
+	defer cancel()
+
+	actor := ActorFromContext(ctx)
+	args := []any{retention.Milliseconds(), actor.UserID, actor.ClientIP, actor.RequestID, AuditResourceProduct, AuditResourceReview, AuditActionPurge}
+	var purged int64
+	err := p.DB.QueryRowContext(ctx, query, args...).Scan(&purged)
+	return purged, err
+}
+
+// GetAll retrieves all products, with filtering, sorting, and pagination.
+// A search that matches nothing falls back to similar spellings of the
+// query, which Metadata.Fuzzy reports.
+func (p ProductModel) GetAll(ctx context.Context, filter ProductFilter, filters Filters) ([]*Product, Metadata, error) {
+	ctx, cancel := p.Timeouts.list(ctx)
 	defer cancel()
 
-	rows, err := p.DB.QueryContext(ctx, query, name, category, filters.limit(), filters.offset())
+	err := p.resolveSearch(ctx, &filter)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
-	defer rows.Close()
+	if filter.fuzzy {
+		filters.SortSafeList = productFuzzySortSafeList
+	}
 
+	from, where, args := filter.where(p.searchLanguage())
+
+	// The exact total of a page comes from the listing query itself; in
+	// cursor mode, or when an estimate is enough, it is counted separately
+	// over the filters alone
+	total := "0"
 	totalRecords := 0
+	if filters.windowCount() {
+		total = "COUNT(*) OVER()"
+	} else if filters.Count != CountNone {
+		totalRecords, err = countRows(ctx, p.DB, from, where, args, filters.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	// In cursor mode rows are located by their sort key instead of being
+	// skipped with OFFSET
+	offset := filters.offset()
+	if !filters.Cursor.IsZero() {
+		condition, cursorArgs := filters.keysetCondition(len(args) + 1)
+		where += "\n\t\tAND " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+	args = append(args, filters.limit(), offset)
+
+	// Searches rank the matches and highlight them
+	search := "0, ''"
+	switch {
+	case filter.fuzzy:
+		search = "GREATEST(word_similarity($1, name), word_similarity($1, category)), ''"
+	case filter.Query != "":
+		search = `ts_rank_cd(search_vector, query),
+			ts_headline($1::regconfig, name || '. ' || description, query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=8')`
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s, id, created_at, updated_at, name, description, category, price, image_url, average_rating, review_count, version,
+			%s
+		FROM %s
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, search, from, where, filters.orderBy(), len(args)-1, len(args))
+
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	windowTotal := 0
 	products := []*Product{}
 
 	for rows.Next() {
 		var product Product
 		err := rows.Scan(
-			&totalRecords,
+			&windowTotal,
 			&product.ID,
 			&product.CreatedAt,
+			&product.UpdatedAt,
 			&product.Name,
 			&product.Description,
 			&product.Category,
 			&product.Price,
 			&product.ImageURL,
 			&product.AverageRating,
+			&product.ReviewCount,
 			&product.Version,
+			&product.Rank,
+			&product.Headline,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -182,6 +672,184 @@ func (p ProductModel) GetAll(name, category string, filters Filters) ([]*Product
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	if filters.windowCount() {
+		totalRecords = windowTotal
+	}
+
+	products, metadata := buildPage(products, filters, totalRecords, productSortValue)
+	metadata.Fuzzy = filter.fuzzy
 	return products, metadata, nil
 }
+
+// resolveSearch switches a search to fuzzy matching when the full-text
+// search finds nothing. The decision does not depend on the page, so that
+// cursors keep working in the mode that produced them.
+func (p ProductModel) resolveSearch(ctx context.Context, filter *ProductFilter) error {
+	if filter.Query == "" {
+		return nil
+	}
+	from, where, args := filter.where(p.searchLanguage())
+	var found bool
+	err := p.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+from+" WHERE "+where+")", args...).Scan(&found)
+	if err != nil {
+		return err
+	}
+	filter.fuzzy = !found
+	return nil
+}
+
+// Suggest returns up to limit products whose name, or a word of it, starts
+// with prefix, names starting with it first and then the most reviewed.
+// The lower(name) prefix index and the trigram index on name serve the two
+// patterns.
+func (p ProductModel) Suggest(ctx context.Context, prefix string, limit int) ([]*ProductSuggestion, error) {
+	escaped := likeEscaper.Replace(strings.ToLower(strings.TrimSpace(prefix)))
+
+	query := `
+		SELECT id, name, category
+		FROM products
+		WHERE (lower(name) LIKE $1 OR name ILIKE $2) AND deleted_at IS NULL
+		ORDER BY lower(name) LIKE $1 DESC, review_count DESC, name, id
+		LIMIT $3
+	`
+	ctx, cancel := p.Timeouts.suggest(ctx)
+	defer cancel()
+
+	rows, err := p.DB.QueryContext(ctx, query, escaped+"%", "% "+escaped+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*ProductSuggestion{}
+	for rows.Next() {
+		var suggestion ProductSuggestion
+		err := rows.Scan(&suggestion.ID, &suggestion.Name, &suggestion.Category)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// likeEscaper escapes the LIKE wildcards, with the default escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ProductSortSafeList maps the sort keys of product listings to columns.
+var ProductSortSafeList = map[string]string{
+	"id":             "id",
+	"name":           "name",
+	"price":          "price",
+	"average_rating": "average_rating",
+	"review_count":   "review_count",
+	"created_at":     "created_at",
+}
+
+// ProductTrashSortSafeList maps the sort keys of the trash listing to
+// columns.
+var ProductTrashSortSafeList = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"deleted_at": "deleted_at",
+}
+
+// ProductSearchSortSafeList extends ProductSortSafeList for searches with
+// relevance, which puts the best matches first ("-relevance" puts them last).
+var ProductSearchSortSafeList = map[string]string{
+	"relevance":      "(-ts_rank_cd(search_vector, query))",
+	"id":             "id",
+	"name":           "name",
+	"price":          "price",
+	"average_rating": "average_rating",
+	"review_count":   "review_count",
+	"created_at":     "created_at",
+}
+
+// productFuzzySortSafeList replaces ProductSearchSortSafeList when a search
+// falls back to similar spellings: relevance is then the word similarity.
+var productFuzzySortSafeList = map[string]string{
+	"relevance":      "(-GREATEST(word_similarity($1, name), word_similarity($1, category)))",
+	"id":             "id",
+	"name":           "name",
+	"price":          "price",
+	"average_rating": "average_rating",
+	"review_count":   "review_count",
+	"created_at":     "created_at",
+}
+
+// productSortValue returns the value of a sort key for a product.
+func productSortValue(product *Product, key string) string {
+	switch key {
+	case "name":
+		return product.Name
+	case "price":
+		return strconv.FormatFloat(product.Price, 'f', -1, 64)
+	case "average_rating":
+		return strconv.FormatFloat(product.AverageRating, 'f', -1, 64)
+	case "review_count":
+		return strconv.Itoa(product.ReviewCount)
+	case "created_at":
+		return product.CreatedAt.Format(time.RFC3339Nano)
+	case "deleted_at":
+		if product.DeletedAt == nil {
+			return ""
+		}
+		return product.DeletedAt.Format(time.RFC3339Nano)
+	case "relevance":
+		return strconv.FormatFloat(-product.Rank, 'f', -1, 64)
+	default:
+		return strconv.FormatInt(product.ID, 10)
+	}
+}
+
+// RecomputeRatings recalculates average_rating and review_count for every
+// product whose stored values disagree with its reviews, and returns how
+// many products were corrected. It is used to backfill existing data. Like
+// refreshProductRating, it leaves the versions alone.
+func (p ProductModel) RecomputeRatings(ctx context.Context) (int64, error) {
+	query := `
+		WITH stats AS (
+			SELECT p.id, COALESCE(ROUND(AVG(r.rating), 2), 0) AS average_rating, COUNT(r.id) AS review_count
+			FROM products p
+			LEFT JOIN reviews r ON r.product_id = p.id AND r.deleted_at IS NULL
+			WHERE p.deleted_at IS NULL
+			GROUP BY p.id
+		)
+		UPDATE products
+		SET average_rating = stats.average_rating, review_count = stats.review_count, updated_at = NOW()
+		FROM stats
+		WHERE products.id = stats.id
+		AND (products.average_rating <> stats.average_rating OR products.review_count <> stats.review_count)
+	`
+	ctx, cancel := p.Timeouts.maintenance(ctx)
+	defer cancel()
+
+	result, err := p.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Reindex rebuilds the search vector of every product with the model's
+// search language, which is needed after changing it. It returns how many
+// products were updated.
+func (p ProductModel) Reindex(ctx context.Context) (int64, error) {
+	query := `
+		UPDATE products
+		SET search_vector = products_search_vector($1, name, description)
+		WHERE search_vector IS DISTINCT FROM products_search_vector($1, name, description)
+	`
+	ctx, cancel := p.Timeouts.maintenance(ctx)
+	defer cancel()
+
+	result, err := p.DB.ExecContext(ctx, query, p.searchLanguage())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
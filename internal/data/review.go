@@ -5,24 +5,48 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/martinezmoises/Test1/internal/validator"
 )
 
 type Review struct {
-	ID           int64     `json:"id"`
-	ProductID    int64     `json:"product_id"`
-	Content      string    `json:"content"`
-	Author       string    `json:"author"`
-	Rating       int       `json:"rating"`
-	HelpfulCount int       `json:"helpful_count"`
-	CreatedAt    time.Time `json:"created_at"`
-	Version      int32     `json:"version"`
+	ID           int64      `json:"id"`
+	ProductID    int64      `json:"product_id"`
+	UserID       int64      `json:"user_id"`
+	Content      string     `json:"content"`
+	Author       string     `json:"author"`
+	Rating       int        `json:"rating"`
+	HelpfulCount int        `json:"helpful_count"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DeletedAt    *time.Time `json:"-"`
+	Version      int32      `json:"version"`
+
+	// deletedWithProduct marks reviews that went to the trash with their
+	// product, in the memory store
+	deletedWithProduct bool
+}
+
+// ReviewStore is the set of operations the handlers need from a review
+// storage backend. ReviewModel (PostgreSQL) and MemoryReviewModel both
+// satisfy it. Operations stop when ctx is done.
+type ReviewStore interface {
+	Insert(ctx context.Context, review *Review) error
+	Get(ctx context.Context, productID, reviewID int64) (*Review, error)
+	Update(ctx context.Context, review *Review) error
+	Delete(ctx context.Context, productID, reviewID int64, version int32) error
+	GetAll(ctx context.Context, productID int64, filters Filters) ([]*Review, Metadata, error)
+	GetTopForProducts(ctx context.Context, productIDs []int64, limit int) (map[int64][]*Review, error)
+	Reassign(ctx context.Context, fromProductID, toProductID int64) (int, error)
 }
 
+// ReviewModel struct wraps the DB connection pool, or a transaction.
 type ReviewModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts QueryTimeouts
 }
 
 // ValidateReview checks the fields of a Review struct.
@@ -34,40 +58,58 @@ func ValidateReview(v *validator.Validator, review *Review) {
 	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
 }
 
-// Insert creates a new review in the database.
-func (m ReviewModel) Insert(review *Review) error {
+// Insert creates a new review in the database and refreshes the product's
+// rating and records an audit event in the same transaction.
+// ErrRecordNotFound is returned if the product does not exist.
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
 	query := `
-		INSERT INTO reviews (product_id, content, author, rating, helpful_count)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at, version
+		INSERT INTO reviews (product_id, user_id, content, author, rating, helpful_count)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at, version
 	`
-	args := []any{review.ProductID, review.Content, review.Author, review.Rating, review.HelpfulCount}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{review.ProductID, review.UserID, review.Content, review.Author, review.Rating, review.HelpfulCount}
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.Version)
+	return transaction(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockProduct(ctx, tx, review.ProductID)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+		if err != nil {
+			return err
+		}
+		err = refreshProductRating(ctx, tx, review.ProductID)
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceReview, review.ID, AuditActionCreate, nil, review)
+	})
 }
 
 // Get retrieves a specific review by its ID and associated product ID.
-func (m ReviewModel) Get(productID, reviewID int64) (*Review, error) {
+func (m ReviewModel) Get(ctx context.Context, productID, reviewID int64) (*Review, error) {
 	query := `
-		SELECT id, product_id, content, author, rating, helpful_count, created_at, version
+		SELECT id, product_id, COALESCE(user_id, 0), content, author, rating, helpful_count, created_at, updated_at, version
 		FROM reviews
-		WHERE product_id = $1 AND id = $2
+		WHERE product_id = $1 AND id = $2 AND deleted_at IS NULL
 	`
 
 	var review Review
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, productID, reviewID).Scan(
 		&review.ID,
 		&review.ProductID,
+		&review.UserID,
 		&review.Content,
 		&review.Author,
 		&review.Rating,
 		&review.HelpfulCount,
 		&review.CreatedAt,
+		&review.UpdatedAt,
 		&review.Version,
 	)
 	if err != nil {
@@ -80,78 +122,288 @@ func (m ReviewModel) Get(productID, reviewID int64) (*Review, error) {
 	return &review, nil
 }
 
-// Update modifies an existing review.
-func (m ReviewModel) Update(review *Review) error {
+// Update modifies an existing review, provided the stored version still
+// matches review.Version; otherwise ErrEditConflict is returned. The
+// product's rating is refreshed and an audit event recorded in the same
+// transaction.
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
 	query := `
 		UPDATE reviews
-		SET content = $1, author = $2, rating = $3, helpful_count = $4, version = version + 1
-		WHERE product_id = $5 AND id = $6
-		RETURNING version
+		SET content = $1, author = $2, rating = $3, helpful_count = $4, version = version + 1, updated_at = NOW()
+		WHERE id = $5
+		RETURNING version, updated_at
 	`
-	args := []any{review.Content, review.Author, review.Rating, review.HelpfulCount, review.ProductID, review.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{review.Content, review.Author, review.Rating, review.HelpfulCount, review.ID}
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&review.Version)
+	return transaction(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockProduct(ctx, tx, review.ProductID)
+		if err != nil {
+			return err
+		}
+		before, err := lockReviewRows(ctx, tx, "product_id = $1 AND id = $2 AND version = $3 AND deleted_at IS NULL", review.ProductID, review.ID, review.Version)
+		if err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return ErrEditConflict
+		}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&review.Version, &review.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		err = refreshProductRating(ctx, tx, review.ProductID)
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceReview, review.ID, AuditActionUpdate, before[0], review)
+	})
 }
 
-// Delete removes a review by its ID and associated product ID.
-func (m ReviewModel) Delete(productID, reviewID int64) error {
+// Delete moves a review to the trash by its ID and associated product ID,
+// provided it is still at the given version, and refreshes the product's
+// rating and records an audit event in the same transaction. Like any other
+// change, moving a review in or out of the trash bumps its version.
+func (m ReviewModel) Delete(ctx context.Context, productID, reviewID int64, version int32) error {
 	query := `
-		DELETE FROM reviews
-		WHERE product_id = $1 AND id = $2
+		UPDATE reviews
+		SET deleted_at = NOW(), version = version + 1, updated_at = NOW()
+		WHERE id = $1
+	`
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return transaction(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockProduct(ctx, tx, productID)
+		if err != nil {
+			return err
+		}
+		before, err := lockReviewRows(ctx, tx, "product_id = $1 AND id = $2 AND version = $3 AND deleted_at IS NULL", productID, reviewID, version)
+		if err != nil {
+			return err
+		}
+		if len(before) == 0 {
+			return ErrEditConflict
+		}
+
+		_, err = tx.ExecContext(ctx, query, reviewID)
+		if err != nil {
+			return err
+		}
+		err = refreshProductRating(ctx, tx, productID)
+		if err != nil {
+			return err
+		}
+		return insertAuditEvent(ctx, tx, AuditResourceReview, reviewID, AuditActionDelete, before[0], nil)
+	})
+}
+
+// Reassign moves every live review of the product fromProductID to the
+// product toProductID and refreshes the ratings of both, returning how many reviews
+// were moved. Each move is recorded as an audit event. ErrRecordNotFound is
+// returned if either product does not exist.
+func (m ReviewModel) Reassign(ctx context.Context, fromProductID, toProductID int64) (int, error) {
+	query := `
+		UPDATE reviews
+		SET product_id = $2, version = version + 1, updated_at = NOW()
+		WHERE product_id = $1 AND deleted_at IS NULL
+		RETURNING id, version, updated_at
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, productID, reviewID)
+	var moved []*Review
+	err := transaction(ctx, m.DB, func(tx *sql.Tx) error {
+		// Lock in ID order so that opposite merges cannot deadlock
+		for _, id := range []int64{min(fromProductID, toProductID), max(fromProductID, toProductID)} {
+			err := lockProduct(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		moved, err = lockReviewRows(ctx, tx, "product_id = $1 AND deleted_at IS NULL", fromProductID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, query, fromProductID, toProductID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		after := make(map[int64]*Review, len(moved))
+		for rows.Next() {
+			var review Review
+			err := rows.Scan(&review.ID, &review.Version, &review.UpdatedAt)
+			if err != nil {
+				return err
+			}
+			after[review.ID] = &review
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, before := range moved {
+			review := *before
+			review.ProductID = toProductID
+			review.Version = after[review.ID].Version
+			review.UpdatedAt = after[review.ID].UpdatedAt
+			err := insertAuditEvent(ctx, tx, AuditResourceReview, review.ID, AuditActionUpdate, before, &review)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = refreshProductRating(ctx, tx, fromProductID)
+		if err != nil {
+			return err
+		}
+		return refreshProductRating(ctx, tx, toProductID)
+	})
+	return len(moved), err
+}
+
+// lockReviewRows reads the reviews selected by condition, whose
+// placeholders are numbered from $1, in ID order, and takes row locks on
+// them.
+func lockReviewRows(ctx context.Context, tx *sql.Tx, condition string, args ...any) ([]*Review, error) {
+	query := `
+		SELECT id, product_id, COALESCE(user_id, 0), content, author, rating, helpful_count, created_at, updated_at, version
+		FROM reviews
+		WHERE ` + condition + `
+		ORDER BY id
+		FOR UPDATE
+	`
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+	var reviews []*Review
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&review.ID,
+			&review.ProductID,
+			&review.UserID,
+			&review.Content,
+			&review.Author,
+			&review.Rating,
+			&review.HelpfulCount,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, &review)
 	}
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
+	return reviews, nil
+}
 
+// lockProduct takes a row lock on the product so that concurrent review
+// writes for the same product serialize, and each rating refresh sees every
+// committed review. Products in the trash are reported as ErrRecordNotFound.
+func lockProduct(ctx context.Context, tx *sql.Tx, productID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, productID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
 	return nil
 }
 
+// refreshProductRating recomputes a product's average_rating and
+// review_count from its reviews. The version counts edits of the product,
+// which have revisions, so it is left alone: review writes must not make
+// concurrent edits of the product conflict. The update time still moves,
+// since the representation changes.
+func refreshProductRating(ctx context.Context, tx *sql.Tx, productID int64) error {
+	query := `
+		UPDATE products
+		SET (average_rating, review_count) = (
+			SELECT COALESCE(ROUND(AVG(rating), 2), 0), COUNT(*)
+			FROM reviews
+			WHERE product_id = $1 AND deleted_at IS NULL
+		), updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err := tx.ExecContext(ctx, query, productID)
+	return err
+}
+
 // GetAll retrieves all reviews for a specific product with filtering, sorting, and pagination.
-func (m ReviewModel) GetAll(productID int64, filters Filters) ([]*Review, Metadata, error) {
-	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, product_id, content, author, rating, helpful_count, created_at, version
-		FROM reviews
-		WHERE (product_id = $1 OR $1 = 0)
-		ORDER BY %s %s, id ASC
-		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+func (m ReviewModel) GetAll(ctx context.Context, productID int64, filters Filters) ([]*Review, Metadata, error) {
+	where := "(product_id = $1 OR $1 = 0) AND deleted_at IS NULL"
+	args := []any{productID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.list(ctx)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, productID, filters.limit(), filters.offset())
+	// See ProductModel.GetAll
+	total := "0"
+	totalRecords := 0
+	if filters.windowCount() {
+		total = "COUNT(*) OVER()"
+	} else if filters.Count != CountNone {
+		var err error
+		totalRecords, err = countRows(ctx, m.DB, "reviews", where, args, filters.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	offset := filters.offset()
+	if !filters.Cursor.IsZero() {
+		condition, cursorArgs := filters.keysetCondition(len(args) + 1)
+		where += " AND " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+	args = append(args, filters.limit(), offset)
+
+	query := fmt.Sprintf(`
+		SELECT %s, id, product_id, COALESCE(user_id, 0), content, author, rating, helpful_count, created_at, updated_at, version
+		FROM reviews
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, where, filters.orderBy(), len(args)-1, len(args))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
-	totalRecords := 0
+	windowTotal := 0
 	reviews := []*Review{}
 
 	for rows.Next() {
 		var review Review
 		err := rows.Scan(
-			&totalRecords,
+			&windowTotal,
 			&review.ID,
 			&review.ProductID,
+			&review.UserID,
 			&review.Content,
 			&review.Author,
 			&review.Rating,
 			&review.HelpfulCount,
 			&review.CreatedAt,
+			&review.UpdatedAt,
 			&review.Version,
 		)
 		if err != nil {
@@ -164,6 +416,109 @@ func (m ReviewModel) GetAll(productID int64, filters Filters) ([]*Review, Metada
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	if filters.windowCount() {
+		totalRecords = windowTotal
+	}
+
+	reviews, metadata := buildPage(reviews, filters, totalRecords, reviewSortValue)
 	return reviews, metadata, nil
 }
+
+// GetTopForProducts returns up to limit reviews of each of the products,
+// the most helpful and then the newest first, keyed by product ID. All the
+// products are read in a single query.
+func (m ReviewModel) GetTopForProducts(ctx context.Context, productIDs []int64, limit int) (map[int64][]*Review, error) {
+	query := `
+		SELECT r.id, r.product_id, COALESCE(r.user_id, 0), r.content, r.author, r.rating, r.helpful_count, r.created_at, r.updated_at, r.version
+		FROM unnest($1::bigint[]) AS p(id)
+		CROSS JOIN LATERAL (
+			SELECT *
+			FROM reviews
+			WHERE product_id = p.id AND deleted_at IS NULL
+			ORDER BY helpful_count DESC, created_at DESC, id DESC
+			LIMIT $2
+		) r
+	`
+	ctx, cancel := m.Timeouts.list(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(productIDs), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := make(map[int64][]*Review, len(productIDs))
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&review.ID,
+			&review.ProductID,
+			&review.UserID,
+			&review.Content,
+			&review.Author,
+			&review.Rating,
+			&review.HelpfulCount,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reviews[review.ProductID] = append(reviews[review.ProductID], &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// Purge permanently removes the reviews that have been in the trash for
+// longer than retention and returns how many there were. Each removal is
+// recorded as an audit event made by the actor of ctx, like
+// ProductModel.Purge.
+func (m ReviewModel) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	query := `
+		WITH purged AS (
+			DELETE FROM reviews
+			WHERE deleted_at <= NOW() - $1::float8 * INTERVAL '1 millisecond'
+			RETURNING id
+		)
+		INSERT INTO audit_events (actor_id, client_ip, request_id, resource, resource_id, action)
+		SELECT NULLIF($2::bigint, 0), NULLIF($3, ''), NULLIF($4, ''), $5::text, id, $6::text
+		FROM purged
+		ORDER BY id
+	`
+	ctx, cancel := m.Timeouts.maintenance(ctx)
+	defer cancel()
+
+	actor := ActorFromContext(ctx)
+	result, err := m.DB.ExecContext(ctx, query, retention.Milliseconds(), actor.UserID, actor.ClientIP, actor.RequestID, AuditResourceReview, AuditActionPurge)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ReviewSortSafeList maps the sort keys of review listings to columns.
+var ReviewSortSafeList = map[string]string{
+	"id":            "id",
+	"rating":        "rating",
+	"helpful_count": "helpful_count",
+	"created_at":    "created_at",
+}
+
+// reviewSortValue returns the value of a sort key for a review.
+func reviewSortValue(review *Review, key string) string {
+	switch key {
+	case "rating":
+		return strconv.Itoa(review.Rating)
+	case "helpful_count":
+		return strconv.Itoa(review.HelpfulCount)
+	case "created_at":
+		return review.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatInt(review.ID, 10)
+	}
+}
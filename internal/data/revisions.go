@@ -0,0 +1,284 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ProductRevision records a create or an update of a product: the fields it
+// set with their new values (every field for a create), who made it and
+// when. Revisions are identified by the version of the product they
+// produced. Deletes and restores also bump the version but do not record
+// revisions, so versions have gaps.
+type ProductRevision struct {
+	ProductID int64          `json:"product_id"`
+	Version   int32          `json:"version"`
+	Changes   map[string]any `json:"changes"`
+	ActorID   int64          `json:"actor_id,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// ProductSnapshot holds the fields of a product that revisions track, as
+// they were at a version.
+type ProductSnapshot struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Category    string  `json:"category"`
+	Price       float64 `json:"price"`
+	ImageURL    string  `json:"image_url"`
+}
+
+// ProductRevisionFields lists the fields that revisions track, named as in
+// JSON.
+var ProductRevisionFields = []string{"name", "description", "category", "price", "image_url"}
+
+// FieldChange is a field that differs between two versions of a product.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// snapshotOf returns the tracked fields of product.
+func snapshotOf(product *Product) ProductSnapshot {
+	return ProductSnapshot{
+		Name:        product.Name,
+		Description: product.Description,
+		Category:    product.Category,
+		Price:       product.Price,
+		ImageURL:    product.ImageURL,
+	}
+}
+
+// values returns the fields of s keyed by their JSON names.
+func (s ProductSnapshot) values() map[string]any {
+	return map[string]any{
+		"name":        s.Name,
+		"description": s.Description,
+		"category":    s.Category,
+		"price":       s.Price,
+		"image_url":   s.ImageURL,
+	}
+}
+
+// Apply sets the tracked fields of product to the ones of s.
+func (s ProductSnapshot) Apply(product *Product) {
+	product.Name = s.Name
+	product.Description = s.Description
+	product.Category = s.Category
+	product.Price = s.Price
+	product.ImageURL = s.ImageURL
+}
+
+// DiffSnapshots lists the fields that differ between from and to, in the
+// order of ProductRevisionFields.
+func DiffSnapshots(from, to ProductSnapshot) []FieldChange {
+	before, after := from.values(), to.values()
+	changes := []FieldChange{}
+	for _, field := range ProductRevisionFields {
+		if before[field] != after[field] {
+			changes = append(changes, FieldChange{Field: field, From: before[field], To: after[field]})
+		}
+	}
+	return changes
+}
+
+// revisionChanges returns the fields of after that differ from before,
+// with their new values, for a revision.
+func revisionChanges(before, after ProductSnapshot) map[string]any {
+	changes := make(map[string]any)
+	for _, change := range DiffSnapshots(before, after) {
+		changes[change.Field] = change.To
+	}
+	return changes
+}
+
+// replayRevisions returns the snapshot produced by revisions, which are in
+// version order and start with a create.
+func replayRevisions(revisions []*ProductRevision) (*ProductSnapshot, error) {
+	values := make(map[string]any)
+	for _, revision := range revisions {
+		for field, value := range revision.Changes {
+			values[field] = value
+		}
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot ProductSnapshot
+	err = json.Unmarshal(encoded, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// ProductRevisionStore is the set of operations the handlers need from a
+// product revision storage backend. ProductRevisionModel (PostgreSQL) and
+// MemoryProductRevisionModel both satisfy it. Revisions are written by the
+// product stores.
+type ProductRevisionStore interface {
+	// GetAll lists the revisions of a product with sorting and pagination.
+	GetAll(ctx context.Context, productID int64, filters Filters) ([]*ProductRevision, Metadata, error)
+	// Get returns the revision that produced a version of a product and
+	// the product's fields at that version. ErrRecordNotFound is returned
+	// if no revision produced the version.
+	Get(ctx context.Context, productID int64, version int32) (*ProductRevision, *ProductSnapshot, error)
+}
+
+// ProductRevisionModel struct wraps the DB connection pool, or a
+// transaction.
+type ProductRevisionModel struct {
+	DB       DBTX
+	Timeouts QueryTimeouts
+}
+
+// insertRevision records a revision of a product made by the actor of ctx.
+func insertRevision(ctx context.Context, tx *sql.Tx, productID int64, version int32, changes map[string]any) error {
+	query := `
+		INSERT INTO product_revisions (product_id, version, changes, actor_id, created_at)
+		SELECT $1, $2, $3::jsonb, NULLIF($4::bigint, 0), updated_at
+		FROM products
+		WHERE id = $1
+	`
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, query, productID, version, string(encoded), ActorFromContext(ctx).UserID)
+	return err
+}
+
+// GetAll lists the revisions of a product with sorting and pagination.
+func (m ProductRevisionModel) GetAll(ctx context.Context, productID int64, filters Filters) ([]*ProductRevision, Metadata, error) {
+	where := "product_id = $1"
+	args := []any{productID}
+
+	ctx, cancel := m.Timeouts.list(ctx)
+	defer cancel()
+
+	// See ProductModel.GetAll
+	total := "0"
+	totalRecords := 0
+	if filters.windowCount() {
+		total = "COUNT(*) OVER()"
+	} else if filters.Count != CountNone {
+		var err error
+		totalRecords, err = countRows(ctx, m.DB, "product_revisions", where, args, filters.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	offset := filters.offset()
+	if !filters.Cursor.IsZero() {
+		condition, cursorArgs := filters.keysetCondition(len(args) + 1)
+		where += " AND " + condition
+		args = append(args, cursorArgs...)
+		offset = 0
+	}
+	args = append(args, filters.limit(), offset)
+
+	query := fmt.Sprintf(`
+		SELECT %s, product_id, version, changes, COALESCE(actor_id, 0), created_at
+		FROM product_revisions
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, where, filters.orderBy(), len(args)-1, len(args))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	windowTotal := 0
+	revisions := []*ProductRevision{}
+
+	for rows.Next() {
+		var revision ProductRevision
+		var changes []byte
+		err := rows.Scan(&windowTotal, &revision.ProductID, &revision.Version, &changes, &revision.ActorID, &revision.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		err = json.Unmarshal(changes, &revision.Changes)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if filters.windowCount() {
+		totalRecords = windowTotal
+	}
+
+	revisions, metadata := buildPage(revisions, filters, totalRecords, revisionSortValue)
+	return revisions, metadata, nil
+}
+
+// Get returns the revision that produced a version of a product, and the
+// product's fields at that version, replayed from its revisions up to it.
+func (m ProductRevisionModel) Get(ctx context.Context, productID int64, version int32) (*ProductRevision, *ProductSnapshot, error) {
+	query := `
+		SELECT product_id, version, changes, COALESCE(actor_id, 0), created_at
+		FROM product_revisions
+		WHERE product_id = $1 AND version <= $2
+		ORDER BY version
+	`
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, productID, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*ProductRevision
+	for rows.Next() {
+		var revision ProductRevision
+		var changes []byte
+		err := rows.Scan(&revision.ProductID, &revision.Version, &changes, &revision.ActorID, &revision.CreatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = json.Unmarshal(changes, &revision.Changes)
+		if err != nil {
+			return nil, nil, err
+		}
+		revisions = append(revisions, &revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(revisions) == 0 || revisions[len(revisions)-1].Version != version {
+		return nil, nil, ErrRecordNotFound
+	}
+	snapshot, err := replayRevisions(revisions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return revisions[len(revisions)-1], snapshot, nil
+}
+
+// ProductRevisionSortSafeList maps the sort keys of revision listings to
+// columns.
+var ProductRevisionSortSafeList = map[string]string{
+	"version": "version",
+}
+
+// revisionSortValue returns the value of a sort key for a revision.
+func revisionSortValue(revision *ProductRevision, key string) string {
+	return strconv.FormatInt(int64(revision.Version), 10)
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// QueryTimeouts bounds how long each kind of model operation may run, on
+// top of the deadline of the caller's context. Zero fields fall back to
+// DefaultQueryTimeouts.
+type QueryTimeouts struct {
+	Read    time.Duration // reading a single record
+	Write   time.Duration // inserts, updates and deletes
+	List    time.Duration // listings, searches and facet counts
+	Suggest time.Duration // name completions, which answer keystrokes
+
+	// Maintenance bounds the statements that sweep whole tables: purges,
+	// rating recomputes, search reindexes and idempotency key cleanups.
+	Maintenance time.Duration
+}
+
+// DefaultQueryTimeouts are the timeouts used when none are configured.
+var DefaultQueryTimeouts = QueryTimeouts{
+	Read:    3 * time.Second,
+	Write:   3 * time.Second,
+	List:    3 * time.Second,
+	Suggest: time.Second,
+
+	Maintenance: time.Minute,
+}
+
+func withTimeout(ctx context.Context, timeout, fallback time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (t QueryTimeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read, DefaultQueryTimeouts.Read)
+}
+
+func (t QueryTimeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write, DefaultQueryTimeouts.Write)
+}
+
+func (t QueryTimeouts) list(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.List, DefaultQueryTimeouts.List)
+}
+
+func (t QueryTimeouts) suggest(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Suggest, DefaultQueryTimeouts.Suggest)
+}
+
+func (t QueryTimeouts) maintenance(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Maintenance, DefaultQueryTimeouts.Maintenance)
+}
+
+// IsTimeout reports whether err comes from an operation that ran out of
+// time, either in database/sql or as a statement PostgreSQL cancelled when
+// the deadline passed.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pgErr *pq.Error
+	return errors.As(err, &pgErr) && pgErr.Code == "57014" // query_canceled
+}
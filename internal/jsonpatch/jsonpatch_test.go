@@ -0,0 +1,384 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func mustDecode(t *testing.T, document string) any {
+	t.Helper()
+	value, err := Decode([]byte(document))
+	if err != nil {
+		t.Fatalf("decode %s: %v", document, err)
+	}
+	return value
+}
+
+func encode(value any) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// The examples of RFC 6902, appendix A, followed by other edge cases.
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		document  string
+		patch     string
+		want      string
+		fails     bool // the patch does not apply
+		testFails bool // a test operation does not hold
+	}{
+		{
+			name:     "A.1 adding an object member",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:     `{"baz": "qux", "foo": "bar"}`,
+		},
+		{
+			name:     "A.2 adding an array element",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:     `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		{
+			name:     "A.3 removing an object member",
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "remove", "path": "/baz"}]`,
+			want:     `{"foo": "bar"}`,
+		},
+		{
+			name:     "A.4 removing an array element",
+			document: `{"foo": ["bar", "qux", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/1"}]`,
+			want:     `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:     "A.5 replacing a value",
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:     `{"baz": "boo", "foo": "bar"}`,
+		},
+		{
+			name:     "A.6 moving a value",
+			document: `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch:    `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:     `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{
+			name:     "A.7 moving an array element",
+			document: `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch:    `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:     `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		{
+			name:     "A.8 testing a value: success",
+			document: `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch:    `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			want:     `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{
+			name:      "A.9 testing a value: error",
+			document:  `{"baz": "qux"}`,
+			patch:     `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			testFails: true,
+		},
+		{
+			name:     "A.10 adding a nested member object",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:     `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		{
+			name:     "A.11 ignoring unrecognized elements",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:     `{"foo": "bar", "baz": "qux"}`,
+		},
+		{
+			name:     "A.12 adding to a nonexistent target",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			fails:    true,
+		},
+		{
+			name:     "A.14 ~ escape ordering",
+			document: `{"/": 9, "~1": 10}`,
+			patch:    `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:     `{"/": 9, "~1": 10}`,
+		},
+		{
+			name:      "A.15 comparing strings and numbers",
+			document:  `{"/": 9, "~1": 10}`,
+			patch:     `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			testFails: true,
+		},
+		{
+			name:     "A.16 adding an array value",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:     `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+		{
+			name:     "~1 refers to a slash",
+			document: `{"a/b": 1, "a": {"b": 2}}`,
+			patch:    `[{"op": "replace", "path": "/a~1b", "value": 3}]`,
+			want:     `{"a/b": 3, "a": {"b": 2}}`,
+		},
+		{
+			name:     "~0 refers to a tilde",
+			document: `{"m~n": 1}`,
+			patch:    `[{"op": "move", "from": "/m~0n", "path": "/~0~1"}]`,
+			want:     `{"~/": 1}`,
+		},
+		{
+			name:     "- appends to a nested array",
+			document: `{"tags": [{"names": []}]}`,
+			patch:    `[{"op": "add", "path": "/tags/0/names/-", "value": "a"}, {"op": "add", "path": "/tags/0/names/-", "value": "b"}]`,
+			want:     `{"tags": [{"names": ["a", "b"]}]}`,
+		},
+		{
+			name:     "- cannot be removed",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/-"}]`,
+			fails:    true,
+		},
+		{
+			name:     "- cannot be replaced",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "replace", "path": "/foo/-", "value": "baz"}]`,
+			fails:    true,
+		},
+		{
+			name:      "- cannot be tested",
+			document:  `{"foo": ["bar"]}`,
+			patch:     `[{"op": "test", "path": "/foo/-", "value": "bar"}]`,
+			testFails: true,
+		},
+		{
+			name:     "- only refers to arrays",
+			document: `{"foo": {"bar": 1}}`,
+			patch:    `[{"op": "add", "path": "/foo/-", "value": 2}]`,
+			want:     `{"foo": {"bar": 1, "-": 2}}`,
+		},
+		{
+			name:     "array index past the end",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/2", "value": "baz"}]`,
+			fails:    true,
+		},
+		{
+			name:     "array index with a leading zero",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/01"}]`,
+			fails:    true,
+		},
+		{
+			name:     "array index with a sign",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/+1"}]`,
+			fails:    true,
+		},
+		{
+			name:     "negative array index",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "add", "path": "/foo/-1", "value": "qux"}]`,
+			fails:    true,
+		},
+		{
+			name:     "copying a value",
+			document: `{"foo": {"bar": [1]}}`,
+			patch:    `[{"op": "copy", "from": "/foo/bar", "path": "/baz"}, {"op": "add", "path": "/baz/-", "value": 2}]`,
+			want:     `{"foo": {"bar": [1]}, "baz": [1, 2]}`,
+		},
+		{
+			name:     "moving a value into itself",
+			document: `{"foo": {"bar": 1}}`,
+			patch:    `[{"op": "move", "from": "/foo", "path": "/foo/baz"}]`,
+			fails:    true,
+		},
+		{
+			name:     "replacing the whole document",
+			document: `{"foo": 1}`,
+			patch:    `[{"op": "replace", "path": "", "value": [1]}]`,
+			want:     `[1]`,
+		},
+		{
+			name:     "numbers compare by value",
+			document: `{"price": 10}`,
+			patch:    `[{"op": "test", "path": "/price", "value": 10.0}, {"op": "test", "path": "/price", "value": 1e1}]`,
+			want:     `{"price": 10}`,
+		},
+		{
+			name:     "objects compare regardless of order",
+			document: `{"foo": {"a": 1, "b": [null, true]}}`,
+			patch:    `[{"op": "test", "path": "/foo", "value": {"b": [null, true], "a": 1}}]`,
+			want:     `{"foo": {"a": 1, "b": [null, true]}}`,
+		},
+		{
+			name:      "a failed test undoes earlier operations",
+			document:  `{"foo": "bar", "list": [1]}`,
+			patch:     `[{"op": "remove", "path": "/foo"}, {"op": "add", "path": "/list/0", "value": 0}, {"op": "test", "path": "/foo", "value": "bar"}]`,
+			testFails: true,
+		},
+		{
+			name:     "a failed operation undoes earlier operations",
+			document: `{"foo": "bar", "list": [1]}`,
+			patch:    `[{"op": "add", "path": "/list/-", "value": 2}, {"op": "remove", "path": "/missing"}]`,
+			fails:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document := mustDecode(t, tt.document)
+			operations, err := DecodePatch([]byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Apply(document, operations)
+			switch {
+			case tt.testFails && !errors.Is(err, ErrTestFailed):
+				t.Fatalf("got error %v, want ErrTestFailed", err)
+			case tt.fails && (err == nil || errors.Is(err, ErrTestFailed)):
+				t.Fatalf("got error %v, want a failed operation", err)
+			case !tt.fails && !tt.testFails && err != nil:
+				t.Fatal(err)
+			}
+
+			// A patch that does not apply leaves the document as it was
+			want := tt.want
+			if tt.fails || tt.testFails {
+				want = tt.document
+			}
+			if !Equal(result, mustDecode(t, want)) {
+				t.Errorf("got %s, want %s", encode(result), want)
+			}
+			if !Equal(document, mustDecode(t, tt.document)) {
+				t.Errorf("the patch modified the document: %s", encode(document))
+			}
+		})
+	}
+}
+
+func TestDecodePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		valid bool
+	}{
+		{"every op", `[{"op": "add", "path": "/a", "value": 1}, {"op": "remove", "path": "/a"}, {"op": "replace", "path": "/a", "value": 1}, {"op": "move", "from": "/a", "path": "/b"}, {"op": "copy", "from": "/a", "path": "/b"}, {"op": "test", "path": "/a", "value": 1}]`, true},
+		{"empty patch", `[]`, true},
+		{"null value", `[{"op": "add", "path": "/a", "value": null}]`, true},
+		{"missing value", `[{"op": "add", "path": "/a"}]`, false},
+		{"missing value to test", `[{"op": "test", "path": "/a"}]`, false},
+		{"unknown op", `[{"op": "increment", "path": "/a", "value": 1}]`, false},
+		{"missing op", `[{"path": "/a"}]`, false},
+		{"pointer without a leading slash", `[{"op": "remove", "path": "a"}]`, false},
+		{"from without a leading slash", `[{"op": "move", "from": "a", "path": "/b"}]`, false},
+		{"object instead of an array", `{"op": "remove", "path": "/a"}`, false},
+		{"op of the wrong type", `[{"op": 1, "path": "/a"}]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodePatch([]byte(tt.patch))
+			if tt.valid && err != nil {
+				t.Errorf("got error %v, want none", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+// The examples of RFC 7396, appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"a": "foo"}`, `null`, `null`},
+		{`{"a": "foo"}`, `"bar"`, `"bar"`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.patch, func(t *testing.T) {
+			target := mustDecode(t, tt.target)
+			result := MergePatch(target, mustDecode(t, tt.patch))
+			if !Equal(result, mustDecode(t, tt.want)) {
+				t.Errorf("got %s, want %s", encode(result), tt.want)
+			}
+			if !Equal(target, mustDecode(t, tt.target)) {
+				t.Errorf("the patch modified the target: %s", encode(target))
+			}
+		})
+	}
+}
+
+// The examples of RFC 6901, section 5.
+func TestPointer(t *testing.T) {
+	document := `{
+		"foo": ["bar", "baz"],
+		"": 0,
+		"a/b": 1,
+		"c%d": 2,
+		"e^f": 3,
+		"g|h": 4,
+		"i\\j": 5,
+		"k\"l": 6,
+		" ": 7,
+		"m~n": 8
+	}`
+	tests := []struct {
+		pointer string
+		want    string
+	}{
+		{``, document},
+		{`/foo`, `["bar", "baz"]`},
+		{`/foo/0`, `"bar"`},
+		{`/`, `0`},
+		{`/a~1b`, `1`},
+		{`/c%d`, `2`},
+		{`/e^f`, `3`},
+		{`/g|h`, `4`},
+		{`/i\j`, `5`},
+		{`/k"l`, `6`},
+		{`/ `, `7`},
+		{`/m~0n`, `8`},
+	}
+
+	value := mustDecode(t, document)
+	for _, tt := range tests {
+		t.Run(tt.pointer, func(t *testing.T) {
+			path, err := parsePointer(tt.pointer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := get(value, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !Equal(got, mustDecode(t, tt.want)) {
+				t.Errorf("got %s, want %s", encode(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Fallback uses Primary (normally Redis) and degrades to Secondary (normally
+// Local) when Primary fails. After a failure Primary is left alone for
+// Cooldown, so that an unreachable store does not add a timeout to every
+// request.
+type Fallback struct {
+	Primary   Limiter
+	Secondary Limiter
+	Cooldown  time.Duration
+	Logger    *slog.Logger
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+// Allow asks Primary, or Secondary while Primary is cooling down or when it
+// returns an error. It only returns an error if Secondary does.
+func (f *Fallback) Allow(ctx context.Context, key string, rule Rule) (Decision, error) {
+	f.mu.Lock()
+	down := time.Now().Before(f.downUntil)
+	f.mu.Unlock()
+
+	if !down {
+		decision, err := f.Primary.Allow(ctx, key, rule)
+		if err == nil {
+			return decision, nil
+		}
+		// A cancelled request says nothing about the health of the store
+		if errors.Is(err, context.Canceled) {
+			return Decision{}, err
+		}
+
+		f.mu.Lock()
+		if time.Now().After(f.downUntil) {
+			f.Logger.Warn("distributed rate limiter unavailable, falling back to local limits", "error", err.Error(), "retry_in", f.Cooldown.String())
+		}
+		f.downUntil = time.Now().Add(f.Cooldown)
+		f.mu.Unlock()
+	}
+
+	return f.Secondary.Allow(ctx, key, rule)
+}
+
+// Close closes both limiters.
+func (f *Fallback) Close() error {
+	return errors.Join(f.Primary.Close(), f.Secondary.Close())
+}
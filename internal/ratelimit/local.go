@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Local keeps one token bucket per key in process memory. Buckets not used
+// for three minutes are evicted by a background goroutine that runs until
+// Close is called.
+type Local struct {
+	mu      sync.Mutex
+	clients map[string]*client
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time // remove map entries that are stale
+}
+
+// NewLocal returns a Local limiter and starts its cleanup goroutine.
+func NewLocal() *Local {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Local{
+		clients: make(map[string]*client),
+		stop:    cancel,
+		done:    make(chan struct{}),
+	}
+	go l.cleanup(ctx)
+	return l
+}
+
+// Allow takes one token from the bucket of key. It never returns an error.
+func (l *Local) Allow(ctx context.Context, key string, rule Rule) (Decision, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, found := l.clients[key]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(rate.Limit(rule.Rate), rule.Burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	allowed := c.limiter.AllowN(now, 1)
+	tokens := c.limiter.TokensAt(now)
+
+	return Decision{
+		Allowed:    allowed,
+		Limit:      rule.Burst,
+		Remaining:  max(int(math.Floor(tokens)), 0),
+		Reset:      secondsToDuration((float64(rule.Burst) - tokens) / rule.Rate),
+		RetryAfter: secondsToDuration((1 - tokens) / rule.Rate),
+	}, nil
+}
+
+// Close stops the cleanup goroutine and waits for it to exit.
+func (l *Local) Close() error {
+	l.stop()
+	<-l.done
+	return nil
+}
+
+// cleanup removes clients not seen for three minutes, once a minute, until
+// ctx is cancelled.
+func (l *Local) cleanup(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			for key, c := range l.clients {
+				if time.Since(c.lastSeen) > 3*time.Minute {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package ratelimit provides token bucket rate limiters that share one
+// interface: Local keeps buckets in process memory, Redis keeps them in a
+// shared Redis-protocol store so that every API replica enforces the same
+// limit, and Fallback combines the two.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Rule is the configuration of a token bucket: it refills at Rate tokens per
+// second and holds at most Burst tokens.
+type Rule struct {
+	Rate  float64
+	Burst int
+}
+
+// Decision is the outcome of checking one request against its bucket.
+type Decision struct {
+	Allowed    bool
+	Limit      int           // bucket size
+	Remaining  int           // whole tokens left after this request
+	Reset      time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // time until the next request would be allowed
+}
+
+// Limiter takes a token for key from a bucket configured by rule.
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (Decision, error)
+	// Close releases background goroutines and connections.
+	Close() error
+}
+
+// SetHeaders writes the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, plus Retry-After when the request was rejected.
+func (d Decision) SetHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", fmt.Sprint(d.Limit))
+	h.Set("RateLimit-Remaining", fmt.Sprint(d.Remaining))
+	h.Set("RateLimit-Reset", fmt.Sprint(ceilSeconds(d.Reset)))
+	if !d.Allowed {
+		h.Set("Retry-After", fmt.Sprint(max(ceilSeconds(d.RetryAfter), 1)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
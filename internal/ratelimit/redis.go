@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcraScript implements the generic cell rate algorithm, which behaves like
+// a token bucket but stores a single timestamp per key: the theoretical
+// arrival time (TAT) of the next request. It runs atomically inside the
+// store and uses the store's clock, so replicas with skewed clocks agree.
+//
+// KEYS[1] = bucket key, ARGV[1] = burst, ARGV[2] = rate (tokens/second).
+// Returns {allowed, remaining, retry_after_seconds, reset_after_seconds};
+// the durations are strings because Lua numbers are truncated to integers
+// in replies.
+//
+// The tests check the script against gcra, the same arithmetic in Go.
+const gcraScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local emission_interval = 1 / rate
+local burst_offset = emission_interval * burst
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+
+local new_tat = tat + emission_interval
+local diff = now - (new_tat - burst_offset)
+
+if diff < 0 then
+	return {0, 0, tostring(-diff), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", KEYS[1], tostring(new_tat), "PX", math.ceil(reset_after * 1000))
+return {1, math.floor(diff / emission_interval), "0", tostring(reset_after)}
+`
+
+var gcraScriptSHA = func() string {
+	sum := sha1.Sum([]byte(gcraScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// Redis keeps buckets in a Redis-protocol store shared by every replica.
+type Redis struct {
+	client *respClient
+	prefix string
+}
+
+// NewRedis returns a limiter that talks to the store at addr. Every command
+// is bounded by timeout so that a slow store cannot stall requests. Keys are
+// prefixed with "ratelimit:".
+func NewRedis(addr, password string, timeout time.Duration) *Redis {
+	return &Redis{
+		client: newRESPClient(addr, password, timeout),
+		prefix: "ratelimit:",
+	}
+}
+
+// Allow takes one token from the bucket of key. Errors mean the store could
+// not be reached or replied unexpectedly.
+func (l *Redis) Allow(ctx context.Context, key string, rule Rule) (Decision, error) {
+	args := []string{"1", l.prefix + key, strconv.Itoa(rule.Burst), strconv.FormatFloat(rule.Rate, 'f', -1, 64)}
+
+	// The script is normally cached by the store; load it on first use
+	reply, err := l.client.do(ctx, append([]string{"EVALSHA", gcraScriptSHA}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = l.client.do(ctx, append([]string{"EVAL", gcraScript}, args...)...)
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 4 {
+		return Decision{}, fmt.Errorf("redis: unexpected rate limit reply %v", reply)
+	}
+	allowed, ok1 := values[0].(int64)
+	remaining, ok2 := values[1].(int64)
+	retryAfter, err1 := parseSeconds(values[2])
+	reset, err2 := parseSeconds(values[3])
+	if !ok1 || !ok2 || err1 != nil || err2 != nil {
+		return Decision{}, fmt.Errorf("redis: unexpected rate limit reply %v", reply)
+	}
+
+	return Decision{
+		Allowed:    allowed == 1,
+		Limit:      rule.Burst,
+		Remaining:  int(remaining),
+		Reset:      reset,
+		RetryAfter: retryAfter,
+	}, nil
+}
+
+// Close closes the connections to the store.
+func (l *Redis) Close() error {
+	return l.client.Close()
+}
+
+func parseSeconds(value any) (time.Duration, error) {
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("expected a string, got %T", value)
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return secondsToDuration(seconds), nil
+}
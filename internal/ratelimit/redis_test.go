@@ -0,0 +1,520 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gcra is gcraScript in Go, for checking the script's replies and for the
+// fake server. A bucket is its theoretical arrival time tat, in seconds on
+// the store's clock; a request at now returns the script's reply and the
+// new tat, which only changes when the request is allowed.
+func gcra(tat, now float64, burst int, rate float64) (gcraReply, float64) {
+	emissionInterval := 1 / rate
+	burstOffset := emissionInterval * float64(burst)
+
+	tat = max(tat, now)
+	newTAT := tat + emissionInterval
+	diff := now - (newTAT - burstOffset)
+
+	if diff < 0 {
+		return gcraReply{retryAfter: -diff, resetAfter: tat - now}, tat
+	}
+	return gcraReply{
+		allowed:    true,
+		remaining:  int(math.Floor(diff / emissionInterval)),
+		resetAfter: newTAT - now,
+	}, newTAT
+}
+
+// gcraReply holds the values returned by gcraScript, in seconds.
+type gcraReply struct {
+	allowed    bool
+	remaining  int
+	retryAfter float64
+	resetAfter float64
+}
+
+// encode returns the reply as the store sends it: durations are converted
+// to strings by Lua, which keeps 14 significant digits.
+func (r gcraReply) encode() string {
+	allowed := 0
+	if r.allowed {
+		allowed = 1
+	}
+	bulk := func(seconds float64) string {
+		s := strconv.FormatFloat(seconds, 'g', 14, 64)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	return fmt.Sprintf("*4\r\n:%d\r\n:%d\r\n", allowed, r.remaining) + bulk(r.retryAfter) + bulk(r.resetAfter)
+}
+
+func TestGCRA(t *testing.T) {
+	type step struct {
+		now  float64
+		want gcraReply
+	}
+	tests := []struct {
+		name  string
+		burst int
+		rate  float64
+		steps []step
+	}{
+		{
+			name:  "burst then refill",
+			burst: 3,
+			rate:  2,
+			steps: []step{
+				{0, gcraReply{allowed: true, remaining: 2, resetAfter: 0.5}},
+				{0, gcraReply{allowed: true, remaining: 1, resetAfter: 1}},
+				{0, gcraReply{allowed: true, remaining: 0, resetAfter: 1.5}},
+				{0, gcraReply{retryAfter: 0.5, resetAfter: 1.5}},
+				{0.25, gcraReply{retryAfter: 0.25, resetAfter: 1.25}},
+				{0.5, gcraReply{allowed: true, remaining: 0, resetAfter: 1.5}},
+				{1.5, gcraReply{allowed: true, remaining: 1, resetAfter: 1}},
+				{10, gcraReply{allowed: true, remaining: 2, resetAfter: 0.5}},
+			},
+		},
+		{
+			name:  "burst of one",
+			burst: 1,
+			rate:  4,
+			steps: []step{
+				{0, gcraReply{allowed: true, remaining: 0, resetAfter: 0.25}},
+				{0.125, gcraReply{retryAfter: 0.125, resetAfter: 0.125}},
+				{0.25, gcraReply{allowed: true, remaining: 0, resetAfter: 0.25}},
+			},
+		},
+		{
+			name:  "slow rate",
+			burst: 2,
+			rate:  0.5,
+			steps: []step{
+				{100, gcraReply{allowed: true, remaining: 1, resetAfter: 2}},
+				{101, gcraReply{allowed: true, remaining: 0, resetAfter: 3}},
+				{102, gcraReply{allowed: true, remaining: 0, resetAfter: 4}},
+				{102.5, gcraReply{retryAfter: 1.5, resetAfter: 3.5}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tat float64
+			for i, step := range tt.steps {
+				var got gcraReply
+				got, tat = gcra(tat, step.now, tt.burst, tt.rate)
+				if got != step.want {
+					t.Errorf("request %d at %gs: got %+v, want %+v", i+1, step.now, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+// fakeRedis is a Redis-protocol server that understands just enough to
+// serve the limiter: AUTH, EVAL and EVALSHA. Scripts are not run: every
+// script call is answered by gcra, on a clock that only moves when a test
+// advances it.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	now      float64            // seconds
+	scripts  map[string]bool    // SHA1 of the scripts loaded with EVAL
+	tats     map[string]float64 // theoretical arrival time per key
+	commands []string           // names of the commands received, in order
+	evals    int                // scripts run
+	down     bool               // drop connections instead of replying
+	delay    time.Duration      // wait before replying
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		scripts:  make(map[string]bool),
+		tats:     make(map[string]float64),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+
+	for {
+		request, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := request.([]any)
+		if !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+
+		reply, delay := f.handle(args, &authenticated)
+		if reply == "" {
+			return
+		}
+		time.Sleep(delay)
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the encoded reply to a command, or "" to drop the
+// connection, and how long to wait before sending it.
+func (f *fakeRedis) handle(args []string, authenticated *bool) (string, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.ToUpper(args[0])
+	f.commands = append(f.commands, name)
+	if f.down {
+		return "", 0
+	}
+
+	switch {
+	case name == "AUTH":
+		if len(args) != 2 || args[1] != f.password {
+			return "-WRONGPASS invalid username-password pair\r\n", f.delay
+		}
+		*authenticated = true
+		return "+OK\r\n", f.delay
+	case !*authenticated:
+		return "-NOAUTH Authentication required.\r\n", f.delay
+	case name == "EVALSHA" && len(args) == 6:
+		if !f.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n", f.delay
+		}
+		return f.run(args[3], args[4], args[5]), f.delay
+	case name == "EVAL" && len(args) == 6:
+		sum := sha1.Sum([]byte(args[1]))
+		f.scripts[hex.EncodeToString(sum[:])] = true
+		return f.run(args[3], args[4], args[5]), f.delay
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0]), f.delay
+	}
+}
+
+// run answers a script call on the bucket of key.
+func (f *fakeRedis) run(key, burstArg, rateArg string) string {
+	burst, _ := strconv.Atoi(burstArg)
+	rate, _ := strconv.ParseFloat(rateArg, 64)
+	f.evals++
+
+	reply, tat := gcra(f.tats[key], f.now, burst, rate)
+	f.tats[key] = tat
+	return reply.encode()
+}
+
+func (f *fakeRedis) advance(seconds float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now += seconds
+}
+
+func (f *fakeRedis) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.commands)
+}
+
+func (f *fakeRedis) scriptsRun() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.evals
+}
+
+func (f *fakeRedis) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func TestRedisAllow(t *testing.T) {
+	server := newFakeRedis(t, "")
+	limiter := NewRedis(server.addr(), "", time.Second)
+	defer limiter.Close()
+
+	rule := Rule{Rate: 2, Burst: 3}
+	tests := []struct {
+		decision Decision
+		headers  http.Header
+	}{
+		{
+			Decision{Allowed: true, Limit: 3, Remaining: 2, Reset: 500 * time.Millisecond},
+			http.Header{"Ratelimit-Limit": {"3"}, "Ratelimit-Remaining": {"2"}, "Ratelimit-Reset": {"1"}},
+		},
+		{
+			Decision{Allowed: true, Limit: 3, Remaining: 1, Reset: time.Second},
+			http.Header{"Ratelimit-Limit": {"3"}, "Ratelimit-Remaining": {"1"}, "Ratelimit-Reset": {"1"}},
+		},
+		{
+			Decision{Allowed: true, Limit: 3, Remaining: 0, Reset: 1500 * time.Millisecond},
+			http.Header{"Ratelimit-Limit": {"3"}, "Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"2"}},
+		},
+		{
+			Decision{Allowed: false, Limit: 3, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond},
+			http.Header{"Ratelimit-Limit": {"3"}, "Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"2"}, "Retry-After": {"1"}},
+		},
+	}
+
+	for i, tt := range tests {
+		decision, err := limiter.Allow(context.Background(), "203.0.113.7", rule)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if decision != tt.decision {
+			t.Errorf("request %d: got decision %+v, want %+v", i+1, decision, tt.decision)
+		}
+		headers := http.Header{}
+		decision.SetHeaders(headers)
+		if fmt.Sprint(headers) != fmt.Sprint(tt.headers) {
+			t.Errorf("request %d: got headers %v, want %v", i+1, headers, tt.headers)
+		}
+	}
+
+	// Buckets are kept under the limiter's prefix, one per key
+	server.mu.Lock()
+	_, found := server.tats["ratelimit:203.0.113.7"]
+	server.mu.Unlock()
+	if !found {
+		t.Errorf("no bucket stored under the prefixed key")
+	}
+	decision, err := limiter.Allow(context.Background(), "198.51.100.1", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || decision.Remaining != 2 {
+		t.Errorf("other key: got decision %+v, want an allowed request with 2 remaining", decision)
+	}
+
+	// Tokens come back at the rate of the rule
+	server.advance(0.75)
+	decision, err = limiter.Allow(context.Background(), "203.0.113.7", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Decision{Allowed: true, Limit: 3, Remaining: 0, Reset: 1250 * time.Millisecond}
+	if decision != want {
+		t.Errorf("after 750ms: got decision %+v, want %+v", decision, want)
+	}
+}
+
+// TestRedisScript runs gcraScript on the store at REDIS_ADDR, when set, and
+// checks its replies against gcra.
+func TestRedisScript(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	limiter := NewRedis(addr, os.Getenv("REDIS_PASSWORD"), time.Second)
+	defer limiter.Close()
+
+	// The store's clock moves between requests, so durations are compared
+	// with some tolerance
+	rule := Rule{Rate: 2, Burst: 3}
+	key := fmt.Sprintf("test:%d", time.Now().UnixNano())
+	var tat float64
+	for i := 0; i < 5; i++ {
+		decision, err := limiter.Allow(context.Background(), key, rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want gcraReply
+		want, tat = gcra(tat, 0, rule.Burst, rule.Rate)
+
+		close := func(got time.Duration, want float64) bool {
+			return math.Abs(got.Seconds()-want) < 0.1
+		}
+		if decision.Allowed != want.allowed || decision.Remaining != want.remaining ||
+			!close(decision.RetryAfter, want.retryAfter) || !close(decision.Reset, want.resetAfter) {
+			t.Errorf("request %d: got decision %+v, want %+v", i+1, decision, want)
+		}
+	}
+}
+
+func TestRedisLoadsScript(t *testing.T) {
+	server := newFakeRedis(t, "")
+	limiter := NewRedis(server.addr(), "", time.Second)
+	defer limiter.Close()
+
+	rule := Rule{Rate: 1, Burst: 5}
+	want := [][]string{
+		{"EVALSHA", "EVAL"},            // unknown script: loaded by EVAL
+		{"EVALSHA", "EVAL", "EVALSHA"}, // cached from then on
+		{"EVALSHA", "EVAL", "EVALSHA", "EVALSHA"},
+	}
+	for i, commands := range want {
+		decision, err := limiter.Allow(context.Background(), "key", rule)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if decision.Remaining != 5-i-1 {
+			t.Errorf("request %d: got %d remaining, want %d", i+1, decision.Remaining, 5-i-1)
+		}
+		if got := server.received(); !slices.Equal(got, commands) {
+			t.Errorf("request %d: server received %v, want %v", i+1, got, commands)
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !server.scripts[gcraScriptSHA] {
+		t.Errorf("script loaded by EVAL does not have the SHA1 sent with EVALSHA")
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{name: "right password", password: "s3cret"},
+		{name: "wrong password", password: "guess", wantErr: "redis auth: WRONGPASS"},
+		{name: "no password", password: "", wantErr: "NOAUTH"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, "s3cret")
+			limiter := NewRedis(server.addr(), tt.password, time.Second)
+			defer limiter.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err := limiter.Allow(context.Background(), "key", Rule{Rate: 1, Burst: 5})
+				if tt.wantErr == "" && err != nil {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+				if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+					t.Fatalf("request %d: got error %v, want %q", i+1, err, tt.wantErr)
+				}
+			}
+
+			// Connections authenticate once, when they are opened
+			if tt.wantErr == "" {
+				want := []string{"AUTH", "EVALSHA", "EVAL", "EVALSHA"}
+				if got := server.received(); !slices.Equal(got, want) {
+					t.Errorf("server received %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisTimeout(t *testing.T) {
+	server := newFakeRedis(t, "")
+	server.delay = time.Second
+	limiter := NewRedis(server.addr(), "", 100*time.Millisecond)
+	defer limiter.Close()
+
+	start := time.Now()
+	_, err := limiter.Allow(context.Background(), "key", Rule{Rate: 1, Burst: 5})
+	elapsed := time.Since(start)
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("request took %v with a timeout of 100ms", elapsed)
+	}
+
+	// A shorter deadline on the context wins over the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = limiter.Allow(ctx, "key", Rule{Rate: 1, Burst: 5})
+	if err == nil {
+		t.Fatal("got no error past the context deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 90*time.Millisecond {
+		t.Errorf("request took %v with a context deadline of 20ms", elapsed)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	server := newFakeRedis(t, "")
+	limiter := &Fallback{
+		Primary:   NewRedis(server.addr(), "", time.Second),
+		Secondary: NewLocal(),
+		Cooldown:  200 * time.Millisecond,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	defer limiter.Close()
+
+	rule := Rule{Rate: 0.001, Burst: 10}
+	allow := func(step string, wantScripts, wantRemaining int) {
+		t.Helper()
+		decision, err := limiter.Allow(context.Background(), "key", rule)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if got := server.scriptsRun(); got != wantScripts {
+			t.Errorf("%s: server ran %d scripts, want %d", step, got, wantScripts)
+		}
+		if !decision.Allowed || decision.Remaining != wantRemaining {
+			t.Errorf("%s: got decision %+v, want an allowed request with %d remaining", step, decision, wantRemaining)
+		}
+	}
+
+	allow("store up", 1, 9)
+
+	// The local buckets start full: they have not seen the earlier request
+	server.setDown(true)
+	allow("store down", 1, 9)
+
+	// The store is left alone during the cooldown, even once it is back
+	server.setDown(false)
+	allow("during the cooldown", 1, 8)
+
+	time.Sleep(250 * time.Millisecond)
+	allow("after the cooldown", 2, 8)
+	allow("store up again", 3, 7)
+}
@@ -1,6 +1,7 @@
 package validator
 
 import (
+	"regexp"
 	"slices"
 )
 
@@ -45,3 +46,11 @@ func (v *Validator) Check(acceptable bool, key string, message string) {
 func PermittedValue(value string, permittedValues ...string) bool {
 	return slices.Contains(permittedValues, value)
 }
+
+// EmailRX is a regular expression for sanity-checking the format of email addresses
+var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// Check if a string value matches a specific regular expression pattern
+func Matches(value string, rx *regexp.Regexp) bool {
+	return rx.MatchString(value)
+}
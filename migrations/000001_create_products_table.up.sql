@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS products (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    description text NOT NULL,
+    category text NOT NULL,
+    price numeric(10, 2) NOT NULL CHECK (price > 0),
+    image_url text NOT NULL DEFAULT '',
+    average_rating numeric(3, 2) NOT NULL DEFAULT 0 CHECK (average_rating BETWEEN 0 AND 5),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS products_name_idx ON products USING GIN (to_tsvector('simple', name));
+CREATE INDEX IF NOT EXISTS products_category_idx ON products (category);
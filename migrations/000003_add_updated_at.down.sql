@@ -0,0 +1,2 @@
+ALTER TABLE reviews DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE products DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,11 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS review_count integer NOT NULL DEFAULT 0;
+
+UPDATE products p
+SET average_rating = stats.average_rating, review_count = stats.review_count
+FROM (
+    SELECT p.id, COALESCE(ROUND(AVG(r.rating), 2), 0) AS average_rating, COUNT(r.id) AS review_count
+    FROM products p
+    LEFT JOIN reviews r ON r.product_id = p.id
+    GROUP BY p.id
+) AS stats
+WHERE p.id = stats.id;
@@ -0,0 +1,5 @@
+-- Reviews written before user accounts existed keep a NULL user_id and only
+-- the free-text author.
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS reviews_user_id_idx ON reviews (user_id);
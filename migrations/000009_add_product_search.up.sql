@@ -0,0 +1,16 @@
+-- Weighted document for full-text search: name (A) ranks above description (B).
+-- The text search configuration is chosen by the API (-search-language), which
+-- also rebuilds the column when it changes (the reindex-search command).
+CREATE OR REPLACE FUNCTION products_search_vector(config regconfig, name text, description text)
+RETURNS tsvector
+LANGUAGE sql IMMUTABLE
+AS $$
+    SELECT setweight(to_tsvector(config, coalesce(name, '')), 'A')
+        || setweight(to_tsvector(config, coalesce(description, '')), 'B')
+$$;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector;
+UPDATE products SET search_vector = products_search_vector('english', name, description);
+ALTER TABLE products ALTER COLUMN search_vector SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS products_search_vector_idx ON products USING GIN (search_vector);
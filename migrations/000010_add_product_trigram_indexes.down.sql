@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS products_name_prefix_idx;
+DROP INDEX IF EXISTS products_category_trgm_idx;
+DROP INDEX IF EXISTS products_name_trgm_idx;
@@ -0,0 +1,6 @@
+-- Typo-tolerant search (name % 'hedphones') and prefix suggestions
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS products_name_trgm_idx ON products USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS products_category_trgm_idx ON products USING GIN (category gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS products_name_prefix_idx ON products (lower(name) text_pattern_ops);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS reviews_product_top_idx;
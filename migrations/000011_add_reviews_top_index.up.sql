@@ -0,0 +1,2 @@
+-- Serves the most helpful reviews of each product, embedded with include=reviews
+CREATE INDEX IF NOT EXISTS reviews_product_top_idx ON reviews (product_id, helpful_count DESC, created_at DESC, id DESC);
@@ -0,0 +1,8 @@
+DELETE FROM reviews WHERE deleted_at IS NOT NULL;
+DELETE FROM products WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS reviews_deleted_at_idx;
+DROP INDEX IF EXISTS products_deleted_at_idx;
+ALTER TABLE reviews DROP COLUMN IF EXISTS deleted_with_product;
+ALTER TABLE reviews DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE products DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,10 @@
+-- Deleted products and reviews stay in the trash, with the time they were
+-- deleted, until the purge command removes them. deleted_with_product marks
+-- the reviews that went to the trash with their product, which restoring
+-- the product brings back.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS deleted_with_product boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS products_deleted_at_idx ON products (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS reviews_deleted_at_idx ON reviews (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS product_revisions;
+DROP FUNCTION IF EXISTS product_revisions_immutable();
@@ -0,0 +1,31 @@
+-- One row per product create or update, holding the fields it set (every
+-- field for a create) with their new values. Replaying the revisions up to a
+-- version gives the product's fields at that version. Rows are never
+-- changed; they only go away with their product.
+CREATE TABLE IF NOT EXISTS product_revisions (
+    product_id bigint NOT NULL REFERENCES products ON DELETE CASCADE,
+    version integer NOT NULL,
+    changes jsonb NOT NULL,
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (product_id, version)
+);
+
+CREATE OR REPLACE FUNCTION product_revisions_immutable() RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+    RAISE EXCEPTION 'product revisions cannot be changed';
+END;
+$$;
+
+DROP TRIGGER IF EXISTS product_revisions_immutable ON product_revisions;
+CREATE TRIGGER product_revisions_immutable BEFORE UPDATE ON product_revisions
+FOR EACH ROW EXECUTE FUNCTION product_revisions_immutable();
+
+-- Existing products start their history at their current version
+INSERT INTO product_revisions (product_id, version, changes, created_at)
+SELECT id, version,
+    jsonb_build_object('name', name, 'description', description, 'category', category, 'price', price, 'image_url', image_url),
+    updated_at
+FROM products
+ON CONFLICT DO NOTHING;
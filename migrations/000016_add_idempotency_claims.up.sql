@@ -0,0 +1,6 @@
+-- claim identifies the request holding a key, so that a request whose
+-- lease was taken over cannot store a response or give the key up.
+-- succeeded marks keys whose request succeeded without its response being
+-- stored; those are never taken over, so the request is not run twice.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS claim bytea NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS succeeded boolean NOT NULL DEFAULT false;
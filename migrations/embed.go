@@ -0,0 +1,10 @@
+// Package migrations embeds the versioned SQL schema migrations so that the
+// api binary can apply them without access to the source tree.
+package migrations
+
+import "embed"
+
+// Files holds every NNNNNN_name.up.sql and NNNNNN_name.down.sql migration.
+//
+//go:embed *.sql
+var Files embed.FS